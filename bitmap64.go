@@ -0,0 +1,351 @@
+package bitmaps
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/customerio/bitmaps/boring"
+)
+
+var bitmap64Magic = uint32(0xFAD4F064)
+
+// ErrOutOfRange is returned by Bitmap64 for the integers whose low 32 bits
+// are not smaller than nbits.
+var ErrOutOfRange = errors.New("value out of range")
+
+// Bitmap64 is a set of uint64. The integers are split by their high 32
+// bits, each of which keys a bitmap holding the low 32 bits. The bitmaps
+// have a capacity of nbits, so the low 32 bits of the integers must be
+// smaller than nbits. Only the non-empty bitmaps are kept.
+type Bitmap64 struct {
+	nbits      int
+	newBitmap  func(nbits int) Bitmap
+	keys       []uint32
+	containers []Bitmap
+}
+
+// NewBitmap64 returns an empty bitmap whose containers have a capacity for
+// nbits of storage and are created with newBitmap, e.g. NewFixed or NewBoring.
+func NewBitmap64(nbits int, newBitmap func(nbits int) Bitmap) *Bitmap64 {
+	return &Bitmap64{
+		nbits:     nbits,
+		newBitmap: newBitmap,
+	}
+}
+
+// NewBitmap64FromBuf returns a bitmap initialized from the marshaled form,
+// whose containers are created with newBitmap. The buffer is always copied.
+// The errors are a *boring.DecodeError, as the containers are read by the
+// boring bitmap, with offsets in buf. The nbits of the header can't exceed
+// boring.MaxUnmarshalNbits.
+func NewBitmap64FromBuf(buf []byte, newBitmap func(nbits int) Bitmap) (*Bitmap64, error) {
+	if len(buf) < 16 {
+		return nil, &boring.DecodeError{Err: boring.ErrInvalidData, Offset: len(buf), Expected: 16, Actual: len(buf)}
+	}
+	if binary.LittleEndian.Uint32(buf) != bitmap64Magic {
+		return nil, &boring.DecodeError{Err: boring.ErrBadMagic}
+	}
+	if version := binary.LittleEndian.Uint32(buf[4:]); version != 1 {
+		return nil, &boring.DecodeError{Err: boring.ErrUnsupportedVersion, Offset: 4}
+	}
+	// Every container allocates nbits, which the header can't be trusted with.
+	nbits := int(binary.LittleEndian.Uint32(buf[8:]))
+	if nbits > boring.MaxUnmarshalNbits {
+		return nil, &boring.DecodeError{Err: boring.ErrNbits, Offset: 8, Expected: boring.MaxUnmarshalNbits, Actual: nbits}
+	}
+	b := NewBitmap64(nbits, newBitmap)
+	n := int(binary.LittleEndian.Uint32(buf[12:]))
+	pos := 16
+	for i := 0; i < n; i++ {
+		if len(buf) < pos+8 {
+			return nil, &boring.DecodeError{Err: boring.ErrInvalidData, Offset: len(buf), Expected: pos + 8, Actual: len(buf)}
+		}
+		key := binary.LittleEndian.Uint32(buf[pos:])
+		size := int(binary.LittleEndian.Uint32(buf[pos+4:]))
+		pos += 8
+		if len(buf) < pos+size {
+			return nil, &boring.DecodeError{Err: boring.ErrSize, Offset: pos - 4, Expected: pos + size, Actual: len(buf)}
+		}
+		if len(b.keys) > 0 && key <= b.keys[len(b.keys)-1] {
+			return nil, &boring.DecodeError{Err: boring.ErrUnsorted, Offset: pos - 8}
+		}
+		// The boring bitmap reads every encoding.
+		o, err := boring.NewBitmapFromBuf(buf[pos:pos+size], b.nbits, true)
+		if err != nil {
+			var de *boring.DecodeError
+			if errors.As(err, &de) {
+				de.Offset += pos
+			}
+			return nil, err
+		}
+		pos += size
+		if o.IsEmpty() {
+			continue
+		}
+		c := newBitmap(b.nbits)
+		c.Or(Boring{o})
+		b.keys = append(b.keys, key)
+		b.containers = append(b.containers, c)
+	}
+	return b, nil
+}
+
+// Marshal returns a portable binary encoding of the bitmap:
+// magic uint32 | version uint32 | nbits uint32 | containers uint32
+// followed for each container by
+// key uint32 | size uint32 | marshaled container
+// all little-endian.
+func (b *Bitmap64) Marshal() ([]byte, error) {
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint32(buf, bitmap64Magic)
+	binary.LittleEndian.PutUint32(buf[4:], 1)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(b.nbits))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(b.keys)))
+	for i, c := range b.containers {
+		data, err := c.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		var prefix [8]byte
+		binary.LittleEndian.PutUint32(prefix[:], b.keys[i])
+		binary.LittleEndian.PutUint32(prefix[4:], uint32(len(data)))
+		buf = append(buf, prefix[:]...)
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+// search returns the index of the container for the key, and whether it exists.
+func (b *Bitmap64) search(key uint32) (int, bool) {
+	i := sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= key })
+	return i, i < len(b.keys) && b.keys[i] == key
+}
+
+func (b *Bitmap64) insert(i int, key uint32, c Bitmap) {
+	b.keys = append(b.keys, 0)
+	copy(b.keys[i+1:], b.keys[i:])
+	b.keys[i] = key
+	b.containers = append(b.containers, nil)
+	copy(b.containers[i+1:], b.containers[i:])
+	b.containers[i] = c
+}
+
+func (b *Bitmap64) delete(i int) {
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	b.containers = append(b.containers[:i], b.containers[i+1:]...)
+}
+
+// outOfRange returns true if the low 32 bits of the integer don't fit in
+// the containers.
+func (b *Bitmap64) outOfRange(v uint64) bool {
+	return int64(uint32(v)) >= int64(b.nbits)
+}
+
+// Add the integer x to the bitmap, returns true if it wasn't already present.
+// The integers out of range are ignored, see TryAdd.
+func (b *Bitmap64) Add(v uint64) bool {
+	if b.outOfRange(v) {
+		return false
+	}
+	i, ok := b.search(uint32(v >> 32))
+	if !ok {
+		b.insert(i, uint32(v>>32), b.newBitmap(b.nbits))
+	}
+	return b.containers[i].Add(uint32(v))
+}
+
+// TryAdd is Add returning ErrOutOfRange for the integers whose low 32 bits
+// are not smaller than nbits.
+func (b *Bitmap64) TryAdd(v uint64) (bool, error) {
+	if b.outOfRange(v) {
+		return false, ErrOutOfRange
+	}
+	return b.Add(v), nil
+}
+
+// Remove the integer x from the bitmap, returns true if it was present.
+func (b *Bitmap64) Remove(v uint64) bool {
+	i, ok := b.search(uint32(v >> 32))
+	if !ok || b.outOfRange(v) {
+		return false
+	}
+	removed := b.containers[i].Remove(uint32(v))
+	if b.containers[i].IsEmpty() {
+		b.delete(i)
+	}
+	return removed
+}
+
+// TryRemove is Remove returning ErrOutOfRange for the integers whose low 32
+// bits are not smaller than nbits.
+func (b *Bitmap64) TryRemove(v uint64) (bool, error) {
+	if b.outOfRange(v) {
+		return false, ErrOutOfRange
+	}
+	return b.Remove(v), nil
+}
+
+// Contains returns true if the integer is contained in the bitmap.
+func (b *Bitmap64) Contains(v uint64) bool {
+	if b.outOfRange(v) {
+		return false
+	}
+	i, ok := b.search(uint32(v >> 32))
+	return ok && b.containers[i].Contains(uint32(v))
+}
+
+// The binary operations require both bitmaps to have the same nbits.
+
+// And computes the intersection between two bitmaps and stores the result in the current bitmap.
+func (b *Bitmap64) And(o *Bitmap64) {
+	if b == o || o == nil {
+		return
+	}
+	keys := b.keys[:0]
+	containers := b.containers[:0]
+	for i, key := range b.keys {
+		j, ok := o.search(key)
+		if !ok {
+			continue
+		}
+		c := b.containers[i]
+		c.And(o.containers[j])
+		if !c.IsEmpty() {
+			keys = append(keys, key)
+			containers = append(containers, c)
+		}
+	}
+	b.keys = keys
+	b.containers = containers
+}
+
+// Or computes the union between two bitmaps and stores the result in the current bitmap.
+func (b *Bitmap64) Or(o *Bitmap64) {
+	if b == o || o == nil {
+		return
+	}
+	for j, key := range o.keys {
+		i, ok := b.search(key)
+		if !ok {
+			b.insert(i, key, b.newBitmap(b.nbits))
+		}
+		b.containers[i].Or(o.containers[j])
+	}
+}
+
+// AndNot computes the difference between two bitmaps and stores the result in the current bitmap.
+func (b *Bitmap64) AndNot(o *Bitmap64) {
+	if o == nil {
+		return
+	}
+	if b == o {
+		b.keys = nil
+		b.containers = nil
+		return
+	}
+	keys := b.keys[:0]
+	containers := b.containers[:0]
+	for i, key := range b.keys {
+		c := b.containers[i]
+		if j, ok := o.search(key); ok {
+			c.AndNot(o.containers[j])
+		}
+		if !c.IsEmpty() {
+			keys = append(keys, key)
+			containers = append(containers, c)
+		}
+	}
+	b.keys = keys
+	b.containers = containers
+}
+
+// Xor computes the symmetric difference between two bitmaps and stores the result in the current bitmap.
+func (b *Bitmap64) Xor(o *Bitmap64) {
+	if o == nil {
+		return
+	}
+	if b == o {
+		b.keys = nil
+		b.containers = nil
+		return
+	}
+	for j, key := range o.keys {
+		i, ok := b.search(key)
+		if !ok {
+			b.insert(i, key, b.newBitmap(b.nbits))
+		}
+		b.containers[i].Xor(o.containers[j])
+		if b.containers[i].IsEmpty() {
+			b.delete(i)
+		}
+	}
+}
+
+// Equals returns true if the two bitmaps hold the same integers.
+func (b *Bitmap64) Equals(o *Bitmap64) bool {
+	if o == nil {
+		return false
+	}
+	if len(b.keys) != len(o.keys) {
+		return false
+	}
+	for i, key := range b.keys {
+		if key != o.keys[i] || !b.containers[i].Equals(o.containers[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone creates a copy of the bitmap.
+func (b *Bitmap64) Clone() *Bitmap64 {
+	c := &Bitmap64{
+		nbits:      b.nbits,
+		newBitmap:  b.newBitmap,
+		keys:       make([]uint32, len(b.keys)),
+		containers: make([]Bitmap, len(b.containers)),
+	}
+	copy(c.keys, b.keys)
+	for i, o := range b.containers {
+		c.containers[i] = o.Clone()
+	}
+	return c
+}
+
+// Iterate calls cb for each integer of the bitmap in sorted order,
+// stopping when cb returns false.
+func (b *Bitmap64) Iterate(cb func(x uint64) bool) {
+	for i, c := range b.containers {
+		high := uint64(b.keys[i]) << 32
+		for it := c.Iterator(); it.HasNext(); {
+			if !cb(high | uint64(it.Next())) {
+				return
+			}
+		}
+	}
+}
+
+// ToArray returns all of the integers stored in the bitmap in sorted order.
+func (b *Bitmap64) ToArray() []uint64 {
+	arr := make([]uint64, 0, b.GetCardinality())
+	b.Iterate(func(x uint64) bool {
+		arr = append(arr, x)
+		return true
+	})
+	return arr
+}
+
+// GetCardinality returns the number of integers contained in the bitmap.
+func (b *Bitmap64) GetCardinality() uint64 {
+	cnt := uint64(0)
+	for _, c := range b.containers {
+		cnt += c.GetCardinality()
+	}
+	return cnt
+}
+
+// IsEmpty returns true if the bitmap is empty.
+func (b *Bitmap64) IsEmpty() bool {
+	return len(b.keys) == 0
+}
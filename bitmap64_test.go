@@ -0,0 +1,206 @@
+package bitmaps
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/customerio/bitmaps/boring"
+)
+
+func TestBitmap64(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		b := NewBitmap64(nbits, impl.newBitmap)
+		values := []uint64{0, 1, 29999, 1 << 32, 1<<32 + 12345, 0xFFFFFFFF00000000 | 7}
+		for _, v := range values {
+			if !b.Add(v) {
+				t.Errorf("expected %d to be added", v)
+			}
+		}
+		if b.Add(1 << 32) {
+			t.Error("values should only be added once")
+		}
+		for _, v := range values {
+			if !b.Contains(v) {
+				t.Errorf("expected %d to be present", v)
+			}
+		}
+		if b.Contains(2) || b.Contains(1<<33) {
+			t.Error("unexpected value present")
+		}
+		if b.GetCardinality() != uint64(len(values)) {
+			t.Error("Unexpected cardinality: ", b.GetCardinality())
+		}
+		if !reflect.DeepEqual(b.ToArray(), values) {
+			t.Error("Unexpected value: ", b.ToArray())
+		}
+
+		b.Remove(0xFFFFFFFF00000000 | 7)
+		if len(b.keys) != 2 {
+			t.Error("empty containers should be removed: ", b.keys)
+		}
+
+		buf, err := b.Marshal()
+		if err != nil {
+			t.Error("Error marshalling: ", err)
+			return
+		}
+		b1, err := NewBitmap64FromBuf(buf, impl.newBitmap)
+		if err != nil {
+			t.Error("Error unmarshalling: ", err)
+			return
+		}
+		if !b1.Equals(b) || !reflect.DeepEqual(b1.ToArray(), values[:5]) {
+			t.Error("Unexpected value: ", b1.ToArray())
+		}
+		if _, err := NewBitmap64FromBuf(buf[:len(buf)-1], impl.newBitmap); !errors.Is(err, boring.ErrSize) {
+			t.Error("Unexpected error: ", err)
+		}
+	})
+}
+
+func TestBitmap64OutOfRange(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		b := NewBitmap64(nbits, impl.newBitmap)
+		v := uint64(1)<<32 | uint64(nbits)
+		if b.Add(v) || b.Contains(v) || b.Remove(v) {
+			t.Error("out of range values should be ignored")
+		}
+		if _, err := b.TryAdd(v); err != ErrOutOfRange {
+			t.Error("Unexpected error: ", err)
+		}
+		if _, err := b.TryRemove(v); err != ErrOutOfRange {
+			t.Error("Unexpected error: ", err)
+		}
+		if added, err := b.TryAdd(v - 1); !added || err != nil {
+			t.Error("TryAdd failed: ", err)
+		}
+		if !reflect.DeepEqual(b.ToArray(), []uint64{v - 1}) {
+			t.Error("Unexpected value: ", b.ToArray())
+		}
+	})
+}
+
+func TestBitmap64DecodeError(t *testing.T) {
+	b := NewBitmap64(nbits, NewBoring)
+	b.Add(1<<32 | 5)
+	b.Add(2<<32 | 7)
+	buf, _ := b.Marshal()
+
+	set := func(f func(buf []byte)) []byte {
+		buf := append([]byte(nil), buf...)
+		f(buf)
+		return buf
+	}
+	second := 16 + 8 + (len(buf)-32)/2
+	for i, test := range []struct {
+		buf []byte
+		err error
+	}{
+		{buf[:10], boring.ErrInvalidData},
+		{buf[:20], boring.ErrInvalidData},
+		{buf[:30], boring.ErrSize},
+		{set(func(buf []byte) { buf[0]++ }), boring.ErrBadMagic},
+		{set(func(buf []byte) { buf[4] = 2 }), boring.ErrUnsupportedVersion},
+		{set(func(buf []byte) { binary.LittleEndian.PutUint32(buf[8:], 1<<32-1) }), boring.ErrNbits},
+		{set(func(buf []byte) { binary.LittleEndian.PutUint32(buf[second:], 1) }), boring.ErrUnsorted},
+		{set(func(buf []byte) { buf[16+8+4]++ }), boring.ErrBadMagic},
+	} {
+		_, err := NewBitmap64FromBuf(test.buf, NewBoring)
+		var de *boring.DecodeError
+		if !errors.Is(err, test.err) || !errors.As(err, &de) {
+			t.Errorf("%d: unexpected error %v", i, err)
+		}
+	}
+
+	// A small header must not allocate huge containers.
+	crafted := make([]byte, 24)
+	binary.LittleEndian.PutUint32(crafted, bitmap64Magic)
+	binary.LittleEndian.PutUint32(crafted[4:], 1)
+	binary.LittleEndian.PutUint32(crafted[8:], 1<<32-1)
+	binary.LittleEndian.PutUint32(crafted[12:], 1)
+	_, err := NewBitmap64FromBuf(crafted, NewBoring)
+	var de *boring.DecodeError
+	if !errors.Is(err, boring.ErrNbits) || !errors.As(err, &de) || de.Offset != 8 {
+		t.Error("Unexpected error: ", err)
+	}
+}
+
+func TestBitmap64Random(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		r := rand.New(rand.NewSource(1))
+		random := func(n int) (*Bitmap64, map[uint64]bool) {
+			b := NewBitmap64(nbits, impl.newBitmap)
+			m := map[uint64]bool{}
+			for i := 0; i < n; i++ {
+				v := uint64(r.Intn(4))<<40 | uint64(r.Intn(nbits))
+				b.Add(v)
+				m[v] = true
+			}
+			return b, m
+		}
+		for i := 0; i < 40; i++ {
+			a, ma := random([]int{50, 1000, 10000}[i%3])
+			b, mb := random([]int{50, 1000, 10000}[(i/3)%3])
+			expected := map[uint64]bool{}
+
+			c := a.Clone()
+			switch i % 4 {
+			case 0:
+				c.And(b)
+				for v := range ma {
+					if mb[v] {
+						expected[v] = true
+					}
+				}
+			case 1:
+				c.Or(b)
+				for v := range ma {
+					expected[v] = true
+				}
+				for v := range mb {
+					expected[v] = true
+				}
+			case 2:
+				c.AndNot(b)
+				for v := range ma {
+					if !mb[v] {
+						expected[v] = true
+					}
+				}
+			case 3:
+				c.Xor(b)
+				for v := range ma {
+					if !mb[v] {
+						expected[v] = true
+					}
+				}
+				for v := range mb {
+					if !ma[v] {
+						expected[v] = true
+					}
+				}
+			}
+			arr := make([]uint64, 0, len(expected))
+			for v := range expected {
+				arr = append(arr, v)
+			}
+			sort.Slice(arr, func(i, j int) bool { return arr[i] < arr[j] })
+			if !reflect.DeepEqual(c.ToArray(), arr) {
+				t.Errorf("%d: unexpected result", i)
+				return
+			}
+			if c.GetCardinality() != uint64(len(arr)) {
+				t.Errorf("%d: expected cardinality %d, but had %d", i, len(arr), c.GetCardinality())
+				return
+			}
+			if a.GetCardinality() != uint64(len(ma)) || b.GetCardinality() != uint64(len(mb)) {
+				t.Errorf("%d: operands should not change", i)
+				return
+			}
+		}
+	})
+}
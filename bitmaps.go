@@ -0,0 +1,405 @@
+// Package bitmaps defines the interface shared by the fixed and boring
+// bitmap implementations, so that code can be written against either.
+package bitmaps
+
+import (
+	"github.com/customerio/bitmaps/boring"
+	"github.com/customerio/bitmaps/fixed"
+)
+
+// Bitmap is a set of uint32 capable of holding nbits of data.
+//
+// The binary operations are fastest when both bitmaps share the
+// same implementation, mixing implementations falls back to
+// iterating over the members of the argument.
+type Bitmap interface {
+	// Add the integer x to the bitmap, returns true if it wasn't already present.
+	Add(v uint32) bool
+	// AddInt adds the integer x to the bitmap.
+	AddInt(v int) bool
+	// Remove the integer x from the bitmap, returns true if it was present.
+	Remove(v uint32) bool
+	// TryAdd is Add returning an error for the integers not smaller than nbits.
+	TryAdd(v uint32) (bool, error)
+	// TryRemove is Remove returning an error for the integers not smaller than nbits.
+	TryRemove(v uint32) (bool, error)
+	// Contains returns true if the integer is contained in the bitmap.
+	Contains(v uint32) bool
+	// Rank returns the number of integers in the bitmap that are smaller or equal to x.
+	Rank(x uint32) uint64
+	// Select returns the integer at position k (counting from 0) in the sorted integers of the bitmap.
+	Select(k uint64) (uint32, bool)
+	// CardinalityInRange returns the number of integers in the given range [start,stop).
+	CardinalityInRange(start, stop int) uint64
+	// ContainsAnyInRange returns true if an integer of the given range [start,stop) is present.
+	ContainsAnyInRange(start, stop int) bool
+	// ContainsAllInRange returns true if all the integers of the given range [start,stop) are present.
+	ContainsAllInRange(start, stop int) bool
+	// ToArrayInRange returns the integers in the given range [start,stop) in sorted order.
+	ToArrayInRange(start, stop int) []uint32
+
+	// And computes the intersection between two bitmaps and stores the result in the current bitmap.
+	And(o Bitmap)
+	// Or computes the union between two bitmaps and stores the result in the current bitmap.
+	Or(o Bitmap)
+	// AndNot computes the difference between two bitmaps and stores the result in the current bitmap.
+	AndNot(o Bitmap)
+	// Xor computes the symmetric difference between two bitmaps and stores the result in the current bitmap.
+	Xor(o Bitmap)
+	// FlipInt negates the bits in the given range [start,stop).
+	FlipInt(start, stop int)
+	// AddRange adds the integers in the given range [start,stop).
+	AddRange(start, stop int)
+	// RemoveRange removes the integers in the given range [start,stop).
+	RemoveRange(start, stop int)
+
+	// AndCardinality returns the cardinality of the intersection between two bitmaps.
+	AndCardinality(o Bitmap) uint64
+	// OrCardinality returns the cardinality of the union between two bitmaps.
+	OrCardinality(o Bitmap) uint64
+	// AndNotCardinality returns the cardinality of the difference between two bitmaps.
+	AndNotCardinality(o Bitmap) uint64
+	// XorCardinality returns the cardinality of the symmetric difference between two bitmaps.
+	XorCardinality(o Bitmap) uint64
+	// Intersects returns true if the two bitmaps have at least one integer in common.
+	Intersects(o Bitmap) bool
+
+	// Equals returns true if the two bitmaps hold the same integers.
+	Equals(o Bitmap) bool
+	// Clone creates a copy of the bitmap.
+	Clone() Bitmap
+	// ToArray returns all of the integers stored in the bitmap in sorted order.
+	ToArray() []uint32
+	// Iterator returns an iterator over the integers of the bitmap in sorted order.
+	Iterator() Iterator
+	// Marshal returns a binary encoding of the bitmap.
+	Marshal() ([]byte, error)
+	// GetCardinality returns the number of integers contained in the bitmap.
+	GetCardinality() uint64
+	// IsEmpty returns true if the bitmap is empty.
+	IsEmpty() bool
+	// Minimum returns the smallest integer in the bitmap, or false if it is empty.
+	Minimum() (uint32, bool)
+	// Maximum returns the largest integer in the bitmap, or false if it is empty.
+	Maximum() (uint32, bool)
+}
+
+// Iterator walks the integers of a bitmap in increasing order, the bitmap
+// must not be modified while iterating.
+type Iterator interface {
+	// HasNext returns true if there are more integers.
+	HasNext() bool
+	// Next returns the next integer, HasNext must be true.
+	Next() uint32
+	// PeekNext returns the next integer without advancing, HasNext must be true.
+	PeekNext() uint32
+	// AdvanceIfNeeded skips the integers smaller than min.
+	AdvanceIfNeeded(min uint32)
+}
+
+// Fixed adapts a *fixed.Bitmap to the Bitmap interface.
+type Fixed struct {
+	*fixed.Bitmap
+}
+
+// NewFixed returns a fixed bitmap with a capacity for nbits of storage.
+func NewFixed(nbits int) Bitmap {
+	return Fixed{fixed.NewBitmap(nbits)}
+}
+
+// And computes the intersection between two bitmaps and stores the result in the current bitmap.
+func (b Fixed) And(o Bitmap) {
+	if f, ok := o.(Fixed); ok {
+		b.Bitmap.And(f.Bitmap)
+		return
+	}
+	and(b, o)
+}
+
+// Or computes the union between two bitmaps and stores the result in the current bitmap.
+func (b Fixed) Or(o Bitmap) {
+	if f, ok := o.(Fixed); ok {
+		b.Bitmap.Or(f.Bitmap)
+		return
+	}
+	or(b, o)
+}
+
+// AndNot computes the difference between two bitmaps and stores the result in the current bitmap.
+func (b Fixed) AndNot(o Bitmap) {
+	if f, ok := o.(Fixed); ok {
+		b.Bitmap.AndNot(f.Bitmap)
+		return
+	}
+	andNot(b, o)
+}
+
+// Xor computes the symmetric difference between two bitmaps and stores the result in the current bitmap.
+func (b Fixed) Xor(o Bitmap) {
+	if f, ok := o.(Fixed); ok {
+		b.Bitmap.Xor(f.Bitmap)
+		return
+	}
+	xor(b, o)
+}
+
+// AndCardinality returns the cardinality of the intersection between two bitmaps.
+func (b Fixed) AndCardinality(o Bitmap) uint64 {
+	if f, ok := o.(Fixed); ok {
+		return b.Bitmap.AndCardinality(f.Bitmap)
+	}
+	return andCardinality(b, o)
+}
+
+// OrCardinality returns the cardinality of the union between two bitmaps.
+func (b Fixed) OrCardinality(o Bitmap) uint64 {
+	return b.GetCardinality() + o.GetCardinality() - b.AndCardinality(o)
+}
+
+// AndNotCardinality returns the cardinality of the difference between two bitmaps.
+func (b Fixed) AndNotCardinality(o Bitmap) uint64 {
+	return b.GetCardinality() - b.AndCardinality(o)
+}
+
+// XorCardinality returns the cardinality of the symmetric difference between two bitmaps.
+func (b Fixed) XorCardinality(o Bitmap) uint64 {
+	return b.GetCardinality() + o.GetCardinality() - 2*b.AndCardinality(o)
+}
+
+// Intersects returns true if the two bitmaps have at least one integer in common.
+func (b Fixed) Intersects(o Bitmap) bool {
+	if f, ok := o.(Fixed); ok {
+		return b.Bitmap.Intersects(f.Bitmap)
+	}
+	return intersects(b, o)
+}
+
+// Equals returns true if the two bitmaps hold the same integers.
+func (b Fixed) Equals(o Bitmap) bool {
+	if f, ok := o.(Fixed); ok {
+		return b.Bitmap.Equals(f.Bitmap)
+	}
+	return equals(b, o)
+}
+
+// Clone creates a copy of the bitmap.
+func (b Fixed) Clone() Bitmap {
+	return Fixed{b.Bitmap.Clone()}
+}
+
+// Iterator returns an iterator over the integers of the bitmap in sorted order.
+func (b Fixed) Iterator() Iterator {
+	return b.Bitmap.Iterator()
+}
+
+// Boring adapts a *boring.Bitmap to the Bitmap interface.
+type Boring struct {
+	*boring.Bitmap
+}
+
+// NewBoring returns a boring bitmap with a capacity for nbits of storage.
+func NewBoring(nbits int) Bitmap {
+	return Boring{boring.NewBitmap(nbits)}
+}
+
+// Add the integer x to the bitmap, returns true if it wasn't already present.
+func (b Boring) Add(v uint32) bool {
+	// Strict bitmaps ignore the integers out of range, which are not
+	// contained either.
+	n := b.GetCardinality()
+	b.Bitmap.Add(v)
+	return b.GetCardinality() != n
+}
+
+// AddInt adds the integer x to the bitmap.
+func (b Boring) AddInt(v int) bool {
+	return b.Add(uint32(v))
+}
+
+// Remove the integer x from the bitmap, returns true if it was present.
+func (b Boring) Remove(v uint32) bool {
+	if !b.Bitmap.Contains(v) {
+		return false
+	}
+	b.Bitmap.Remove(v)
+	return true
+}
+
+// TryAdd is Add returning boring.ErrOutOfRange for the integers not smaller than nbits.
+func (b Boring) TryAdd(v uint32) (bool, error) {
+	n := b.GetCardinality()
+	if err := b.Bitmap.TryAdd(v); err != nil {
+		return false, err
+	}
+	return b.GetCardinality() != n, nil
+}
+
+// TryRemove is Remove returning boring.ErrOutOfRange for the integers not smaller than nbits.
+func (b Boring) TryRemove(v uint32) (bool, error) {
+	n := b.GetCardinality()
+	if err := b.Bitmap.TryRemove(v); err != nil {
+		return false, err
+	}
+	return b.GetCardinality() != n, nil
+}
+
+// And computes the intersection between two bitmaps and stores the result in the current bitmap.
+func (b Boring) And(o Bitmap) {
+	if f, ok := o.(Boring); ok {
+		b.Bitmap.And(f.Bitmap)
+		return
+	}
+	and(b, o)
+}
+
+// Or computes the union between two bitmaps and stores the result in the current bitmap.
+func (b Boring) Or(o Bitmap) {
+	if f, ok := o.(Boring); ok {
+		b.Bitmap.Or(f.Bitmap)
+		return
+	}
+	or(b, o)
+}
+
+// AndNot computes the difference between two bitmaps and stores the result in the current bitmap.
+func (b Boring) AndNot(o Bitmap) {
+	if f, ok := o.(Boring); ok {
+		b.Bitmap.AndNot(f.Bitmap)
+		return
+	}
+	andNot(b, o)
+}
+
+// Xor computes the symmetric difference between two bitmaps and stores the result in the current bitmap.
+func (b Boring) Xor(o Bitmap) {
+	if f, ok := o.(Boring); ok {
+		b.Bitmap.Xor(f.Bitmap)
+		return
+	}
+	xor(b, o)
+}
+
+// AndCardinality returns the cardinality of the intersection between two bitmaps.
+func (b Boring) AndCardinality(o Bitmap) uint64 {
+	if f, ok := o.(Boring); ok {
+		return b.Bitmap.AndCardinality(f.Bitmap)
+	}
+	return andCardinality(b, o)
+}
+
+// OrCardinality returns the cardinality of the union between two bitmaps.
+func (b Boring) OrCardinality(o Bitmap) uint64 {
+	return b.GetCardinality() + o.GetCardinality() - b.AndCardinality(o)
+}
+
+// AndNotCardinality returns the cardinality of the difference between two bitmaps.
+func (b Boring) AndNotCardinality(o Bitmap) uint64 {
+	return b.GetCardinality() - b.AndCardinality(o)
+}
+
+// XorCardinality returns the cardinality of the symmetric difference between two bitmaps.
+func (b Boring) XorCardinality(o Bitmap) uint64 {
+	return b.GetCardinality() + o.GetCardinality() - 2*b.AndCardinality(o)
+}
+
+// Intersects returns true if the two bitmaps have at least one integer in common.
+func (b Boring) Intersects(o Bitmap) bool {
+	if f, ok := o.(Boring); ok {
+		return b.Bitmap.Intersects(f.Bitmap)
+	}
+	return intersects(b, o)
+}
+
+// Equals returns true if the two bitmaps hold the same integers.
+func (b Boring) Equals(o Bitmap) bool {
+	if f, ok := o.(Boring); ok {
+		return b.Bitmap.Equals(f.Bitmap)
+	}
+	return equals(b, o)
+}
+
+// Clone creates a copy of the bitmap.
+func (b Boring) Clone() Bitmap {
+	return Boring{b.Bitmap.Clone()}
+}
+
+// Iterator returns an iterator over the integers of the bitmap in sorted order.
+func (b Boring) Iterator() Iterator {
+	return b.Bitmap.Iterator()
+}
+
+// The generic implementations used when mixing implementations.
+
+func and(b Bitmap, o Bitmap) {
+	if o == nil {
+		return
+	}
+	for _, v := range b.ToArray() {
+		if !o.Contains(v) {
+			b.Remove(v)
+		}
+	}
+}
+
+func or(b Bitmap, o Bitmap) {
+	if o == nil {
+		return
+	}
+	for _, v := range o.ToArray() {
+		b.Add(v)
+	}
+}
+
+func andNot(b Bitmap, o Bitmap) {
+	if o == nil {
+		return
+	}
+	for _, v := range o.ToArray() {
+		b.Remove(v)
+	}
+}
+
+func xor(b Bitmap, o Bitmap) {
+	if o == nil {
+		return
+	}
+	for _, v := range o.ToArray() {
+		if !b.Remove(v) {
+			b.Add(v)
+		}
+	}
+}
+
+func andCardinality(b Bitmap, o Bitmap) uint64 {
+	cnt := uint64(0)
+	for _, v := range o.ToArray() {
+		if b.Contains(v) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func intersects(b Bitmap, o Bitmap) bool {
+	for _, v := range o.ToArray() {
+		if b.Contains(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func equals(b Bitmap, o Bitmap) bool {
+	if o == nil {
+		return false
+	}
+	if b.GetCardinality() != o.GetCardinality() {
+		return false
+	}
+	for _, v := range o.ToArray() {
+		if !b.Contains(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,621 @@
+package bitmaps
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/customerio/bitmaps/boring"
+	"github.com/customerio/bitmaps/fixed"
+)
+
+var nbits = 30000
+
+type implementation struct {
+	name      string
+	newBitmap func(nbits int) Bitmap
+	fromBuf   func(buf []byte, nbits int) (Bitmap, error)
+}
+
+var implementations = []implementation{
+	{
+		name:      "fixed",
+		newBitmap: NewFixed,
+		fromBuf: func(buf []byte, nbits int) (Bitmap, error) {
+			b, err := fixed.NewBitmapFromBuf(buf, nbits, true)
+			if err != nil {
+				return nil, err
+			}
+			return Fixed{b}, nil
+		},
+	},
+	{
+		name:      "boring",
+		newBitmap: NewBoring,
+		fromBuf: func(buf []byte, nbits int) (Bitmap, error) {
+			b, err := boring.NewBitmapFromBuf(buf, nbits, true)
+			if err != nil {
+				return nil, err
+			}
+			return Boring{b}, nil
+		},
+	},
+}
+
+// conform runs the test against every implementation.
+func conform(t *testing.T, test func(t *testing.T, impl implementation)) {
+	for _, impl := range implementations {
+		impl := impl
+		t.Run(impl.name, func(t *testing.T) {
+			test(t, impl)
+		})
+	}
+}
+
+func TestAdd(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		b := impl.newBitmap(nbits)
+		arr := []uint32{}
+		for v := uint32(0); v < uint32(nbits); v += 100 {
+			if !b.Add(v) {
+				t.Error("Add failed")
+			}
+			if b.Add(v) {
+				t.Error("Add failed")
+			}
+			arr = append(arr, v)
+		}
+		if !reflect.DeepEqual(b.ToArray(), arr) {
+			t.Error("Add failed")
+		}
+	})
+}
+
+func TestTryAdd(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		b := impl.newBitmap(nbits)
+		if added, err := b.TryAdd(7); !added || err != nil {
+			t.Error("TryAdd failed: ", err)
+		}
+		if added, err := b.TryAdd(7); added || err != nil {
+			t.Error("TryAdd failed: ", err)
+		}
+		if _, err := b.TryAdd(uint32(nbits)); err == nil {
+			t.Error("out of range values should be rejected")
+		}
+		if removed, err := b.TryRemove(7); !removed || err != nil {
+			t.Error("TryRemove failed: ", err)
+		}
+		if _, err := b.TryRemove(1 << 31); err == nil {
+			t.Error("out of range values should be rejected")
+		}
+		if !b.IsEmpty() {
+			t.Error("Unexpected value: ", b.ToArray())
+		}
+	})
+}
+
+func TestStrictAdd(t *testing.T) {
+	for _, b := range []Bitmap{
+		Fixed{fixed.NewBitmap(nbits, fixed.Strict())},
+		Boring{boring.NewBitmap(nbits, boring.Strict())},
+	} {
+		if b.Add(uint32(nbits)) || b.Remove(uint32(nbits)) {
+			t.Errorf("%T: out of range values should be ignored", b)
+		}
+		if !b.Add(7) || b.Add(7) {
+			t.Errorf("%T: Add failed", b)
+		}
+		if !reflect.DeepEqual(b.ToArray(), []uint32{7}) {
+			t.Errorf("%T: unexpected value %v", b, b.ToArray())
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		b := impl.newBitmap(nbits)
+		for v := uint32(0); v < uint32(nbits); v += 2 {
+			b.Add(v)
+		}
+		b1 := impl.newBitmap(nbits)
+		for v := uint32(1); v < uint32(nbits); v += 2 {
+			b1.Add(v)
+		}
+		c := b.Clone()
+		c.Or(b1)
+		if b.GetCardinality() != uint64(nbits/2) {
+			t.Error("Or failed")
+			return
+		}
+		if c.GetCardinality() != uint64(nbits) {
+			t.Error("Or failed")
+			return
+		}
+	})
+}
+
+func TestOrShort(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		b := impl.newBitmap(nbits)
+		for v := uint32(0); v < uint32(nbits); v += 100 {
+			o := impl.newBitmap(nbits)
+			for vv := v; vv < v+100; vv++ {
+				o.Add(vv)
+			}
+			b.Or(o)
+		}
+		if b.GetCardinality() != uint64(nbits) {
+			t.Error("Or failed")
+			return
+		}
+	})
+}
+
+func TestEquals(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		a := impl.newBitmap(nbits)
+		c := impl.newBitmap(nbits)
+		if !a.Equals(c) {
+			t.Error("Two empty sets of the same size should be equal")
+			return
+		}
+		a.Add(99)
+		c.Add(0)
+		if a.Equals(c) {
+			t.Error("Two sets with differences should not be equal")
+			return
+		}
+		c.Add(99)
+		a.Add(0)
+		if !a.Equals(c) {
+			t.Error("Two sets with the same bits set should be equal")
+			return
+		}
+	})
+}
+
+func TestRemove(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		b := impl.newBitmap(nbits)
+		for v := uint32(0); v < uint32(nbits); v += 100 {
+			b.Add(v)
+		}
+		for v := uint32(0); v < uint32(nbits); v += 100 {
+			if !b.Remove(v) {
+				t.Error("Remove failed")
+			}
+			if b.Remove(v) {
+				t.Error("Remove failed")
+			}
+			if b.Contains(v) {
+				t.Errorf("bitmap should not contain %d", v)
+			}
+		}
+		if !b.IsEmpty() {
+			t.Error("bitmap should be empty")
+		}
+	})
+}
+
+func TestOr(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		a := impl.newBitmap(nbits)
+		b := impl.newBitmap(nbits)
+		for i := uint32(1); i < 100; i += 2 {
+			a.Add(i)
+			b.Add(i - 1)
+		}
+		for i := uint32(100); i < 200; i++ {
+			b.Add(i)
+		}
+		c := a.Clone()
+		c.Or(b)
+		d := b.Clone()
+		d.Or(a)
+		if c.GetCardinality() != 200 {
+			t.Errorf("Union should have 200 bits set, but had %d", c.GetCardinality())
+		}
+		if !c.Equals(d) {
+			t.Errorf("Union should be symmetric")
+		}
+	})
+}
+
+func TestAnd(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		a := impl.newBitmap(nbits)
+		b := impl.newBitmap(nbits)
+		for i := uint32(1); i < 100; i += 2 {
+			a.Add(i)
+			b.Add(i - 1)
+			b.Add(i)
+		}
+		for i := uint32(100); i < 200; i++ {
+			b.Add(i)
+		}
+		c := a.Clone()
+		c.And(b)
+		d := b.Clone()
+		d.And(a)
+		if c.GetCardinality() != 50 {
+			t.Errorf("Intersection should have 50 bits set, but had %d", c.GetCardinality())
+		}
+		if !c.Equals(d) {
+			t.Errorf("Intersection should be symmetric")
+		}
+	})
+}
+
+func TestAndNot(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		a := impl.newBitmap(nbits)
+		b := impl.newBitmap(nbits)
+		for i := uint32(0); i < 50; i++ {
+			a.Add(i)
+		}
+		for i := uint32(50); i < 150; i++ {
+			b.Add(i)
+		}
+		for i := uint32(100); i < 150; i++ {
+			a.Add(i)
+		}
+		c := a.Clone()
+		c.AndNot(b)
+		d := b.Clone()
+		d.AndNot(a)
+		if c.GetCardinality() != 50 {
+			t.Errorf("a-b Difference should have 50 bits set, but had %d", c.GetCardinality())
+		}
+		if d.GetCardinality() != 50 {
+			t.Errorf("b-a Difference should have 50 bits set, but had %d", d.GetCardinality())
+		}
+		if c.Equals(d) {
+			t.Errorf("Difference, here, should not be symmetric")
+		}
+	})
+}
+
+func TestXor(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		a := impl.newBitmap(nbits)
+		b := impl.newBitmap(nbits)
+		for i := uint32(0); i < 100; i++ {
+			a.Add(i)
+		}
+		for i := uint32(50); i < 250; i++ {
+			b.Add(i)
+		}
+		c := a.Clone()
+		c.Xor(b)
+		d := b.Clone()
+		d.Xor(a)
+		if c.GetCardinality() != 200 {
+			t.Errorf("Symmetric difference should have 200 bits set, but had %d", c.GetCardinality())
+		}
+		if !c.Equals(d) {
+			t.Errorf("Symmetric difference should be symmetric")
+		}
+	})
+}
+
+func TestRankSelect(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		b := impl.newBitmap(nbits)
+		for _, v := range []uint32{3, 64, 65, 1000, 29999} {
+			b.Add(v)
+		}
+		for _, tc := range []struct {
+			x    uint32
+			rank uint64
+		}{{0, 0}, {3, 1}, {63, 1}, {64, 2}, {999, 3}, {1000, 4}, {29999, 5}} {
+			if r := b.Rank(tc.x); r != tc.rank {
+				t.Errorf("Rank(%d) should be %d, but was %d", tc.x, tc.rank, r)
+			}
+		}
+		if v, ok := b.Select(3); !ok || v != 1000 {
+			t.Errorf("Select(3) should be 1000, but was %d", v)
+		}
+		if _, ok := b.Select(5); ok {
+			t.Error("Select(5) should fail")
+		}
+	})
+}
+
+func TestFlipRange(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		b := impl.newBitmap(nbits)
+		for _, v := range []uint32{1, 3, 5, 7, 9, 11, 13, 15} {
+			b.Add(v)
+		}
+		b.FlipInt(4, 25)
+		if b.GetCardinality() != 17 {
+			t.Error("Unexpected value: ", b.GetCardinality())
+			return
+		}
+		if !reflect.DeepEqual(b.ToArray(), []uint32{1, 3, 4, 6, 8, 10, 12, 14, 16, 17, 18, 19, 20, 21, 22, 23, 24}) {
+			t.Error("Unexpected value: ", b.ToArray())
+		}
+		b.FlipInt(8, 24)
+		if !reflect.DeepEqual(b.ToArray(), []uint32{1, 3, 4, 6, 9, 11, 13, 15, 24}) {
+			t.Error("Unexpected value: ", b.ToArray())
+			return
+		}
+	})
+}
+
+func TestFlipWholeRange(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		for _, n := range []int{1000, 1024, nbits} {
+			b := impl.newBitmap(n)
+			b.FlipInt(0, n)
+			if b.GetCardinality() != uint64(n) {
+				t.Errorf("%d: expected cardinality %d, but had %d", n, n, b.GetCardinality())
+			}
+			min, _ := b.Minimum()
+			max, _ := b.Maximum()
+			if min != 0 || max != uint32(n-1) {
+				t.Errorf("%d: unexpected range [%d,%d]", n, min, max)
+			}
+			// Ranges beyond nbits are clamped.
+			b.FlipInt(n/2, n+100)
+			if b.GetCardinality() != uint64(n/2) {
+				t.Errorf("%d: expected cardinality %d, but had %d", n, n/2, b.GetCardinality())
+			}
+		}
+	})
+}
+
+func TestMarshalUnmarshal(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		for _, step := range []uint32{0, 1000, 2} {
+			b := impl.newBitmap(nbits)
+			if step > 0 {
+				for v := uint32(0); v < uint32(nbits); v += step {
+					b.Add(v)
+				}
+			}
+			buf, err := b.Marshal()
+			if err != nil {
+				t.Error("Error marshalling: ", err)
+				return
+			}
+			b1, err := impl.fromBuf(buf, nbits)
+			if err != nil {
+				t.Error("Error unmarshalling: ", err)
+				return
+			}
+			if !b1.Equals(b) {
+				t.Error("bitmaps should be equal")
+			}
+		}
+	})
+}
+
+func TestMixedImplementations(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		for _, other := range implementations {
+			a := impl.newBitmap(nbits)
+			b := other.newBitmap(nbits)
+			for i := uint32(0); i < 100; i++ {
+				a.Add(i)
+			}
+			for i := uint32(50); i < 250; i++ {
+				b.Add(i)
+			}
+
+			c := a.Clone()
+			c.And(b)
+			if c.GetCardinality() != 50 {
+				t.Errorf("%s: Intersection should have 50 bits set, but had %d", other.name, c.GetCardinality())
+			}
+			c = a.Clone()
+			c.Or(b)
+			if c.GetCardinality() != 250 {
+				t.Errorf("%s: Union should have 250 bits set, but had %d", other.name, c.GetCardinality())
+			}
+			c = a.Clone()
+			c.AndNot(b)
+			if c.GetCardinality() != 50 {
+				t.Errorf("%s: Difference should have 50 bits set, but had %d", other.name, c.GetCardinality())
+			}
+			c = a.Clone()
+			c.Xor(b)
+			if c.GetCardinality() != 200 {
+				t.Errorf("%s: Symmetric difference should have 200 bits set, but had %d", other.name, c.GetCardinality())
+			}
+			if c := a.AndCardinality(b); c != 50 {
+				t.Errorf("%s: Intersection should have 50 bits set, but had %d", other.name, c)
+			}
+			if c := a.XorCardinality(b); c != 200 {
+				t.Errorf("%s: Symmetric difference should have 200 bits set, but had %d", other.name, c)
+			}
+			if !a.Intersects(b) {
+				t.Errorf("%s: bitmaps should intersect", other.name)
+			}
+			c = other.newBitmap(nbits)
+			c.Or(a)
+			if !c.Equals(a) || !a.Equals(c) {
+				t.Errorf("%s: bitmaps should be equal", other.name)
+			}
+		}
+	})
+}
+
+// TestIterator checks a leapfrog join of the iterators against And.
+func TestIterator(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		r := rand.New(rand.NewSource(1))
+		var bitmaps []Bitmap
+		expected := impl.newBitmap(nbits)
+		expected.FlipInt(0, nbits)
+		for i := 0; i < 3; i++ {
+			b := impl.newBitmap(nbits)
+			for j := 0; j < 5000; j++ {
+				b.Add(uint32(r.Intn(nbits)))
+			}
+			bitmaps = append(bitmaps, b)
+			expected.And(b)
+		}
+
+		// A leapfrog join of the bitmaps.
+		var its []Iterator
+		for _, b := range bitmaps {
+			its = append(its, b.Iterator())
+		}
+		var values []uint32
+		max := uint32(0)
+		for {
+			done := false
+			for _, it := range its {
+				it.AdvanceIfNeeded(max)
+				if !it.HasNext() {
+					done = true
+					break
+				}
+				if v := it.PeekNext(); v > max {
+					max = v
+				}
+			}
+			if done {
+				break
+			}
+			same := true
+			for _, it := range its {
+				if it.PeekNext() != max {
+					same = false
+				}
+			}
+			if same {
+				values = append(values, max)
+				its[0].Next()
+			}
+		}
+		if !reflect.DeepEqual(values, expected.ToArray()) {
+			t.Error("Unexpected value: ", values)
+		}
+	})
+}
+
+func TestRandom(t *testing.T) {
+	conform(t, func(t *testing.T, impl implementation) {
+		r := rand.New(rand.NewSource(1))
+		size := nbits
+		random := func(max int) (Bitmap, map[uint32]bool) {
+			b := impl.newBitmap(size)
+			m := map[uint32]bool{}
+			n := r.Intn(max)
+			for i := 0; i < n; i++ {
+				v := uint32(r.Intn(size))
+				b.Add(v)
+				m[v] = true
+			}
+			return b, m
+		}
+		for i := 0; i < 400; i++ {
+			if i == 200 {
+				// Values that don't fit in a uint16.
+				size = 1 << 20
+			}
+			a, ma := random([]int{50, 200, 5000}[i%3])
+			b, mb := random([]int{50, 200, 5000}[(i/3)%3])
+			expected := map[uint32]bool{}
+
+			and := 0
+			for v := range ma {
+				if mb[v] {
+					and++
+				}
+			}
+			if c := a.AndCardinality(b); c != uint64(and) {
+				t.Errorf("%d: expected intersection cardinality %d, but had %d", i, and, c)
+			}
+			if c := a.OrCardinality(b); c != uint64(len(ma)+len(mb)-and) {
+				t.Errorf("%d: expected union cardinality %d, but had %d", i, len(ma)+len(mb)-and, c)
+			}
+			if c := a.AndNotCardinality(b); c != uint64(len(ma)-and) {
+				t.Errorf("%d: expected difference cardinality %d, but had %d", i, len(ma)-and, c)
+			}
+			if c := a.XorCardinality(b); c != uint64(len(ma)+len(mb)-2*and) {
+				t.Errorf("%d: expected symmetric difference cardinality %d, but had %d", i, len(ma)+len(mb)-2*and, c)
+			}
+			if a.Intersects(b) != (and > 0) {
+				t.Errorf("%d: Intersects should be %v", i, and > 0)
+			}
+
+			c := a.Clone()
+			switch i % 4 {
+			case 0:
+				c.And(b)
+				for v := range ma {
+					if mb[v] {
+						expected[v] = true
+					}
+				}
+			case 1:
+				c.Or(b)
+				for v := range ma {
+					expected[v] = true
+				}
+				for v := range mb {
+					expected[v] = true
+				}
+			case 2:
+				c.AndNot(b)
+				for v := range ma {
+					if !mb[v] {
+						expected[v] = true
+					}
+				}
+			case 3:
+				c.Xor(b)
+				for v := range ma {
+					if !mb[v] {
+						expected[v] = true
+					}
+				}
+				for v := range mb {
+					if !ma[v] {
+						expected[v] = true
+					}
+				}
+			}
+			if !reflect.DeepEqual(c.ToArray(), sorted(expected)) {
+				t.Errorf("%d: unexpected result", i)
+				return
+			}
+			if c.GetCardinality() != uint64(len(expected)) {
+				t.Errorf("%d: expected cardinality %d, but had %d", i, len(expected), c.GetCardinality())
+				return
+			}
+			if !reflect.DeepEqual(a.ToArray(), sorted(ma)) || !reflect.DeepEqual(b.ToArray(), sorted(mb)) {
+				t.Errorf("%d: operands should not change", i)
+				return
+			}
+			buf, err := c.Marshal()
+			if err != nil {
+				t.Errorf("%d: error marshalling: %v", i, err)
+				return
+			}
+			d, err := impl.fromBuf(buf, size)
+			if err != nil {
+				t.Errorf("%d: error unmarshalling: %v", i, err)
+				return
+			}
+			if !d.Equals(c) {
+				t.Errorf("%d: unexpected result after unmarshalling", i)
+				return
+			}
+		}
+	})
+}
+
+func sorted(m map[uint32]bool) []uint32 {
+	arr := make([]uint32, 0, len(m))
+	for v := range m {
+		arr = append(arr, v)
+	}
+	sort.Slice(arr, func(i, j int) bool { return arr[i] < arr[j] })
+	return arr
+}
@@ -42,6 +42,50 @@ func (b *array) remove(v uint32) {
 	}
 }
 
+// lowerBound returns the index of the first integer not smaller than v.
+func (b *array) lowerBound(v int) int {
+	if v <= 0 {
+		return 0
+	}
+	if v > 0xFFFF {
+		return len(b.content)
+	}
+	loc := binarySearch(b.content, uint16(v))
+	if loc < 0 {
+		return -loc - 1
+	}
+	return loc
+}
+
+// addRange adds the integers in [start,stop), the content is updated in
+// place so the result must fit in the buffer.
+func (b *array) addRange(start, stop int) {
+	lo, hi := b.lowerBound(start), b.lowerBound(stop)
+	s := b.content[:lo+stop-start+len(b.content)-hi]
+	copy(s[lo+stop-start:], b.content[hi:])
+	for v := start; v < stop; v++ {
+		s[lo+v-start] = uint16(v)
+	}
+	b.content = s
+}
+
+// removeRange removes the integers in [start,stop).
+func (b *array) removeRange(start, stop int) {
+	lo, hi := b.lowerBound(start), b.lowerBound(stop)
+	b.content = append(b.content[:lo], b.content[hi:]...)
+}
+
+func (b *array) rank(v uint32) int {
+	if v > 0xFFFF {
+		return len(b.content)
+	}
+	loc := binarySearch(b.content, uint16(v))
+	if loc >= 0 {
+		return loc + 1
+	}
+	return -loc - 1
+}
+
 func (b *array) and(o array) {
 	length := intersection2by2(b.content, o.content, b.content)
 	b.content = b.content[:length]
@@ -55,10 +99,57 @@ func (b *array) andBitmap(o bitmap) {
 		pos += o.bitValue(uint32(v))
 	}
 	content = content[:pos]
-	b.content = toUint16Slice(b.buf[8:], len(content))
+	b.content = toUint16Slice(b.buf[extHeaderSize:], len(content))
 	copy(b.content, content)
 }
 
+func (b *array) andCardinality(o array) int {
+	return intersectionCardinality2by2(b.content, o.content)
+}
+
+func (b *array) andCardinalityBitmap(o bitmap) int {
+	cnt := 0
+	for _, v := range b.content {
+		cnt += o.bitValue(uint32(v))
+	}
+	return cnt
+}
+
+func (b *array) intersects(o array) bool {
+	return intersects2by2(b.content, o.content)
+}
+
+func (b *array) intersectsBitmap(o bitmap) bool {
+	for _, v := range b.content {
+		if o.contains(uint32(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *array) andRun(o run) {
+	pos := 0
+	for _, v := range b.content {
+		if o.contains(uint32(v)) {
+			b.content[pos] = v
+			pos++
+		}
+	}
+	b.content = b.content[:pos]
+}
+
+func (b *array) andNotRun(o run) {
+	pos := 0
+	for _, v := range b.content {
+		if !o.contains(uint32(v)) {
+			b.content[pos] = v
+			pos++
+		}
+	}
+	b.content = b.content[:pos]
+}
+
 func (b *array) or(o array) {
 	lb := len(b.content)
 	lo := len(o.content)
@@ -66,9 +157,11 @@ func (b *array) or(o array) {
 
 	// Since we never utilitize more than 50% of the buffer space
 	// we know the max size is never more than the entire buffer.
-	b.content = toUint16Slice(b.buf[8:], max)
-	copy(b.content[lo:max], o.content[:lb])
-	l := union2by2(b.content[lb:max], o.content, b.content)
+	// The current content is moved to the end so that the union can
+	// be written from the start without overwriting unread values.
+	b.content = toUint16Slice(b.buf[extHeaderSize:], max)
+	copy(b.content[lo:max], b.content[:lb])
+	l := union2by2(b.content[lo:max], o.content, b.content)
 	b.content = b.content[:l]
 }
 
@@ -82,7 +175,7 @@ func (b *array) andNotBitmap(o bitmap) {
 	copy(src, b.content)
 
 	b.content = b.content[:0]
-	for _, e := range b.content {
+	for _, e := range src {
 		v := uint32(e)
 		if !o.contains(v) {
 			b.add(v)
@@ -90,6 +183,13 @@ func (b *array) andNotBitmap(o bitmap) {
 	}
 }
 
+func (b *array) xor(o array) {
+	content := make([]uint16, len(b.content)+len(o.content))
+	l := exclusiveUnion2by2(b.content, o.content, content)
+	b.content = toUint16Slice(b.buf[extHeaderSize:], l)
+	copy(b.content, content[:l])
+}
+
 func (b *array) equals(o array) bool {
 	l := len(b.content)
 	for i := 0; i < l; i++ {
@@ -203,6 +303,64 @@ func union2by2(set1 []uint16, set2 []uint16, buffer []uint16) int {
 	return pos
 }
 
+func exclusiveUnion2by2(set1 []uint16, set2 []uint16, buffer []uint16) int {
+	pos := 0
+	k1 := 0
+	k2 := 0
+	if 0 == len(set2) {
+		buffer = buffer[:len(set1)]
+		copy(buffer, set1[:])
+		return len(set1)
+	}
+	if 0 == len(set1) {
+		buffer = buffer[:len(set2)]
+		copy(buffer, set2[:])
+		return len(set2)
+	}
+	s1 := set1[k1]
+	s2 := set2[k2]
+	buffer = buffer[:cap(buffer)]
+	for {
+		if s1 < s2 {
+			buffer[pos] = s1
+			pos++
+			k1++
+			if k1 >= len(set1) {
+				copy(buffer[pos:], set2[k2:])
+				pos += len(set2) - k2
+				break
+			}
+			s1 = set1[k1]
+		} else if s1 == s2 {
+			k1++
+			k2++
+			if k1 >= len(set1) {
+				copy(buffer[pos:], set2[k2:])
+				pos += len(set2) - k2
+				break
+			}
+			if k2 >= len(set2) {
+				copy(buffer[pos:], set1[k1:])
+				pos += len(set1) - k1
+				break
+			}
+			s1 = set1[k1]
+			s2 = set2[k2]
+		} else { // if (set1[k1]>set2[k2])
+			buffer[pos] = s2
+			pos++
+			k2++
+			if k2 >= len(set2) {
+				copy(buffer[pos:], set1[k1:])
+				pos += len(set1) - k1
+				break
+			}
+			s2 = set2[k2]
+		}
+	}
+	return pos
+}
+
 func intersection2by2(
 	set1 []uint16,
 	set2 []uint16,
@@ -217,6 +375,51 @@ func intersection2by2(
 	}
 }
 
+func intersectionCardinality2by2(set1 []uint16, set2 []uint16) int {
+	if len(set1) > len(set2) {
+		set1, set2 = set2, set1
+	}
+	if len(set1)*64 < len(set2) {
+		cnt := 0
+		for _, v := range set1 {
+			if binarySearch(set2, v) >= 0 {
+				cnt++
+			}
+		}
+		return cnt
+	}
+	cnt := 0
+	k1 := 0
+	k2 := 0
+	for k1 < len(set1) && k2 < len(set2) {
+		if set1[k1] < set2[k2] {
+			k1++
+		} else if set1[k1] > set2[k2] {
+			k2++
+		} else {
+			cnt++
+			k1++
+			k2++
+		}
+	}
+	return cnt
+}
+
+func intersects2by2(set1 []uint16, set2 []uint16) bool {
+	k1 := 0
+	k2 := 0
+	for k1 < len(set1) && k2 < len(set2) {
+		if set1[k1] < set2[k2] {
+			k1++
+		} else if set1[k1] > set2[k2] {
+			k2++
+		} else {
+			return true
+		}
+	}
+	return false
+}
+
 func onesidedgallopingintersect2by2(
 	smallset []uint16,
 	largeset []uint16,
@@ -433,3 +636,43 @@ func difference(set1 []uint16, set2 []uint16, buffer []uint16) int {
 	return pos
 
 }
+
+// nextMany appends the integers larger or equal to i in increasing order, up to limit.
+func (b *array) nextMany(i uint32, buffer []uint32, limit int) ([]uint32, bool) {
+	if i > 0xFFFF {
+		return buffer, false
+	}
+	j := binarySearch(b.content, uint16(i))
+	if j < 0 {
+		j = -j - 1
+	}
+	size := 0
+	for ; j < len(b.content); j++ {
+		buffer = append(buffer, uint32(b.content[j]))
+		size++
+		if size == limit {
+			return buffer, true
+		}
+	}
+	return buffer, false
+}
+
+// prevMany appends the integers smaller or equal to i in decreasing order, up to limit.
+func (b *array) prevMany(i uint32, buffer []uint32, limit int) ([]uint32, bool) {
+	j := len(b.content) - 1
+	if i <= 0xFFFF {
+		j = binarySearch(b.content, uint16(i))
+		if j < 0 {
+			j = -j - 2
+		}
+	}
+	size := 0
+	for ; j >= 0; j-- {
+		buffer = append(buffer, uint32(b.content[j]))
+		size++
+		if size == limit {
+			return buffer, true
+		}
+	}
+	return buffer, false
+}
@@ -1,163 +1,419 @@
 package boring
 
 import (
-	"errors"
-	"fmt"
+	"encoding/binary"
+	"math/bits"
 	"reflect"
 	"unsafe"
 )
 
-// Note that the marshaled form of the bitmap is not portable -- it is assumed to be the
-// same endianness as the machine that created the marshaled form
+// Marshal produces the portable form of the bitmap, which is always little-endian.
+// Bytes exposes the internal buffer which is in the native byte order of the host,
+// and is tagged with the legacy encodings. NewBitmapFromBuf reads both.
 var (
 	// Memory is layed out as follows:
 	// header | data
 	// The data block is a fixed size block of memory with enough space to old nbits of storage.
 	// For bitmaps:
-	// 8 bytes| []uint64 bits
+	// 16 bytes| []uint64 bits
 	// For arrays
-	// 8 bytes| []uint16 contents
+	// 16 bytes| []uint16 contents
+	// For runs
+	// 16 bytes| []uint16 start, length pairs
+	// The header has room for the version 2 header, so marshaled forms
+	// can be used in place. Bytes writes the legacy header to its second half.
+	extHeaderSize = 16
+
+	// headerSize is the size of the legacy and version 1 headers.
 	headerSize = 8
 
 	// For storing uint16 the buffer has capacity to store 1,875 uint16 (30k/16)
 
-	bitmapMagic    = uint32(0xFAD4F00D)
+	bitmapMagic = uint32(0xFAD4F00D)
+
+	// Legacy encodings, the data is in the byte order of the host that wrote it.
 	encodingBitmap = byte(0xF0)
 	encodingArray  = byte(0x0F)
+	encodingRun    = byte(0xCC)
+
+	// Portable encodings, the header and data are always little-endian.
+	encodingBitmapLE = byte(0xF1)
+	encodingArrayLE  = byte(0x1F)
+	encodingRunLE    = byte(0xC1)
+
+	// The array of uint32 encoding is only used by the marshaled form of
+	// bitmaps whose values don't fit in a uint16, those bitmaps always
+	// use the bitmap encoding internally.
+	encodingArray32LE = byte(0x2F)
+	array16Bits       = 1 << 16
+
+	// formatVersion is stored in the header of the portable encodings.
+	formatVersion = byte(2)
 )
 
+// Bitmap is a set of integers smaller than nbits, held in an array, a
+// bitmap or runs depending on its content. The binary operations only ever
+// modify the receiver, the argument is treated as read-only so it can be
+// shared between goroutines.
 type Bitmap struct {
-	buf      []byte
-	encoding byte
-	nbits    int
-	array    array
-	bitmap   bitmap
+	buf       []byte
+	encoding  byte
+	nbits     int
+	array     array
+	bitmap    bitmap
+	run       run
+	strict    bool
+	jsonArray bool
 }
 
 // NewBitmap returns a fixed size bitmap with a capacity for nbits of storage.
-func NewBitmap(nbits int) *Bitmap {
+func NewBitmap(nbits int, opts ...Option) *Bitmap {
 	totalSize := totalSize(nbits)
 	buf := make([]byte, totalSize)
+	encoding := encodingArray
+	if nbits > array16Bits {
+		encoding = encodingBitmap
+	}
+	o := newOptions(opts)
+	b := newBitmap(buf, nbits, encoding)
+	b.strict = o.strict
+	b.jsonArray = o.jsonArray
+	return b
+}
+
+// newBitmap returns a bitmap using buf for its storage, the content of the
+// encoding must be set up by the caller.
+func newBitmap(buf []byte, nbits int, encoding byte) *Bitmap {
 	return &Bitmap{
 		buf:      buf,
 		nbits:    nbits,
-		encoding: encodingArray,
+		encoding: encoding,
 		array: array{
 			buf:     buf,
-			content: toUint16Slice(buf[headerSize:], 0),
+			content: toUint16Slice(buf[extHeaderSize:], 0),
 			// once we go over this limit, we'll change to a bitmap.
 			sz: bodySize(nbits) / (16 * 2),
 		},
 		bitmap: bitmap{
 			buf:         buf,
-			set:         toUint64Slice(buf[headerSize:]),
+			set:         toUint64Slice(buf[extHeaderSize:]),
 			cardinality: 0,
 		},
+		run: run{
+			buf:     buf,
+			content: toUint16Slice(buf[extHeaderSize:], 0),
+			// runs take twice the space of array values.
+			sz: bodySize(nbits) / (16 * 4),
+		},
 	}
 }
 
 // NewBitmapFromBuf returns a fixed size bitmap with a capacity for nbits of storage.
 // The bitmap is initialized from the marshaled form. If copyBuffer is true, the buffer
-// is copied, otherwise it may be used by the bitmap itself.
-func NewBitmapFromBuf(buf []byte, nbits int, copyBuffer bool) (*Bitmap, error) {
+// is copied, otherwise it may be used by the bitmap itself. The marshaled form is
+// trusted unless the Validate option is given.
+func NewBitmapFromBuf(buf []byte, nbits int, copyBuffer bool, opts ...Option) (*Bitmap, error) {
+	o := newOptions(opts)
 	if len(buf) < headerSize {
-		return nil, errors.New("invalid data")
+		return nil, &DecodeError{Err: ErrInvalidData, Offset: len(buf), Expected: headerSize, Actual: len(buf)}
 	}
 	var h header
 	h.read(buf)
 	if h.magic != bitmapMagic {
-		return nil, errors.New("bad magic")
+		return nil, &DecodeError{Err: ErrBadMagic, Offset: 4}
 	}
+	encoding := h.encoding
 
-	totalSize := totalSize(nbits)
+	hsize := headerSize
+	switch h.encoding {
+	case encodingBitmapLE, encodingArrayLE, encodingRunLE, encodingArray32LE:
+		switch h.version {
+		case 1:
+		case formatVersion:
+			hsize = extHeaderSize
+			if len(buf) < hsize {
+				return nil, &DecodeError{Err: ErrInvalidData, Encoding: encoding, Offset: len(buf), Expected: hsize, Actual: len(buf)}
+			}
+			h.readExt(buf)
+			if h.flags&^flagChecksum != 0 {
+				return nil, &DecodeError{Err: ErrUnsupportedFlags, Encoding: encoding}
+			}
+			if h.flags&flagChecksum != 0 {
+				var err error
+				if buf, err = verifyChecksum(buf, encoding); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, &DecodeError{Err: ErrUnsupportedVersion, Encoding: encoding, Offset: 2}
+		}
+		if !littleEndian {
+			buf = toNativeEndian(buf, h.encoding, hsize)
+			copyBuffer = false
+		}
+		h.encoding = legacyEncoding(h.encoding)
+	}
+
+	bodySize := bodySize(nbits)
 	switch h.encoding {
 	case encodingBitmap:
-		if copyBuffer {
-			dst := make([]byte, totalSize)
-			copy(dst, buf)
+		if len(buf) != hsize+bodySize {
+			return nil, &DecodeError{Err: ErrSize, Encoding: encoding, Offset: len(buf), Expected: hsize + bodySize, Actual: len(buf)}
+		}
+		if hsize == extHeaderSize && int(h.nbits) != nbits {
+			return nil, &DecodeError{Err: ErrNbits, Encoding: encoding, Offset: 12, Expected: nbits, Actual: int(h.nbits)}
+		}
+		if copyBuffer || hsize != extHeaderSize {
+			dst := make([]byte, extHeaderSize+bodySize)
+			copy(dst[extHeaderSize:], buf[hsize:])
 			buf = dst
 		}
-		if len(buf) != totalSize {
-			return nil, fmt.Errorf("bitmap expects %d bytes", totalSize)
-		}
-		return &Bitmap{
-			buf:      buf,
-			encoding: encodingBitmap,
-			nbits:    nbits,
-			array: array{
-				buf:     buf,
-				content: toUint16Slice(buf[headerSize:], 0),
-				// once we go over this limit, we'll change to a bitmap.
-				sz: bodySize(nbits) / (16 * 2),
-			},
-			bitmap: bitmap{
-				buf:         buf,
-				set:         toUint64Slice(buf[headerSize:]),
-				cardinality: int(h.cardinality),
-			},
-		}, nil
+		b := newBitmap(buf, nbits, encodingBitmap)
+		b.strict = o.strict
+		b.jsonArray = o.jsonArray
+		b.bitmap.cardinality = int(h.cardinality)
+		if hsize == headerSize {
+			// Older headers truncate the cardinality to 16 bits.
+			b.bitmap.cardinality = int(b.bitmap.computeCardinality())
+		}
+		if o.validate {
+			if i, err := validateWords(b.bitmap.set, nbits, h.cardinality, hsize == headerSize); err != nil {
+				return nil, &DecodeError{Err: err, Encoding: encoding, Offset: hsize + i*8}
+			}
+		}
+		return b, nil
 
 	case encodingArray:
-		dst := make([]byte, totalSize)
-		copy(dst, buf)
+		if len(buf) != hsize+int(h.cardinality)*2 {
+			return nil, &DecodeError{Err: ErrSize, Encoding: encoding, Offset: len(buf), Expected: hsize + int(h.cardinality)*2, Actual: len(buf)}
+		}
+		if int(h.cardinality)*2 > bodySize {
+			return nil, &DecodeError{Err: ErrTooLarge, Encoding: encoding, Offset: 8, Expected: bodySize, Actual: int(h.cardinality) * 2}
+		}
+		dst := make([]byte, extHeaderSize+bodySize)
+		copy(dst[extHeaderSize:], buf[hsize:])
+		buf = dst
+
+		b := newBitmap(buf, nbits, encodingArray)
+		b.strict = o.strict
+		b.jsonArray = o.jsonArray
+		b.array.content = toUint16Slice(buf[extHeaderSize:], int(h.cardinality))
+		if o.validate {
+			// convertMaybe keeps arrays smaller than sz, which is 0 for
+			// small nbits where only empty arrays remain.
+			if len(b.array.content) > 0 && len(b.array.content) >= b.array.sz {
+				return nil, &DecodeError{Err: ErrTooLarge, Encoding: encoding, Offset: 8, Expected: max(b.array.sz-1, 0) * 2, Actual: len(b.array.content) * 2}
+			}
+			if i, err := validateArray(b.array.content, nbits); err != nil {
+				return nil, &DecodeError{Err: err, Encoding: encoding, Offset: hsize + i*2}
+			}
+		}
+		if b.wide() {
+			// Older versions wrote arrays for any nbits.
+			b.convertEncoding(encodingBitmap)
+		}
+		return b, nil
+
+	case encodingRun:
+		// The cardinality of the header holds the number of runs.
+		if len(buf) != hsize+int(h.cardinality)*4 {
+			return nil, &DecodeError{Err: ErrSize, Encoding: encoding, Offset: len(buf), Expected: hsize + int(h.cardinality)*4, Actual: len(buf)}
+		}
+		if int(h.cardinality)*4 > bodySize {
+			return nil, &DecodeError{Err: ErrTooLarge, Encoding: encoding, Offset: 8, Expected: bodySize, Actual: int(h.cardinality) * 4}
+		}
+		dst := make([]byte, extHeaderSize+bodySize)
+		copy(dst[extHeaderSize:], buf[hsize:])
 		buf = dst
 
-		return &Bitmap{
-			buf:      buf,
-			nbits:    nbits,
-			encoding: encodingArray,
-			array: array{
-				buf:     buf,
-				content: toUint16Slice(buf[headerSize:], int(h.cardinality)),
-				// once we go over this limit, we'll change to a bitmap.
-				sz: bodySize(nbits) / (16 * 2),
-			},
-			bitmap: bitmap{
-				buf:         buf,
-				set:         toUint64Slice(buf[headerSize:]),
-				cardinality: 0,
-			},
-		}, nil
-	}
-	return nil, fmt.Errorf("bad encoding")
-}
-
-// Bytes returns a pointer to the content of the bitmap.
+		b := newBitmap(buf, nbits, encodingRun)
+		b.strict = o.strict
+		b.jsonArray = o.jsonArray
+		b.run.content = toUint16Slice(buf[extHeaderSize:], int(h.cardinality)*2)
+		if o.validate {
+			if b.run.numRuns() >= b.run.sz {
+				return nil, &DecodeError{Err: ErrTooLarge, Encoding: encoding, Offset: 8, Expected: (b.run.sz - 1) * 4, Actual: b.run.numRuns() * 4}
+			}
+			if i, err := validateRuns(b.run.content, nbits); err != nil {
+				return nil, &DecodeError{Err: err, Encoding: encoding, Offset: hsize + i*4}
+			}
+		}
+		b.run.cardinality = b.run.computeCardinality()
+		if b.wide() {
+			b.convertEncoding(encodingBitmap)
+		}
+		return b, nil
+
+	case encodingArray32LE:
+		if len(buf) != hsize+int(h.cardinality)*4 {
+			return nil, &DecodeError{Err: ErrSize, Encoding: encoding, Offset: len(buf), Expected: hsize + int(h.cardinality)*4, Actual: len(buf)}
+		}
+		b := NewBitmap(nbits, opts...)
+		if h.cardinality > 0 {
+			data := toUint32Slice(buf[hsize:], int(h.cardinality))
+			if o.validate {
+				if i, err := validateArray(data, nbits); err != nil {
+					return nil, &DecodeError{Err: err, Encoding: encoding, Offset: hsize + i*4}
+				}
+			}
+			for i, v := range data {
+				if int(v) >= nbits {
+					return nil, &DecodeError{Err: ErrOutOfRange, Encoding: encoding, Offset: hsize + i*4}
+				}
+				b.Add(v)
+			}
+		}
+		return b, nil
+	}
+	return nil, &DecodeError{Err: ErrBadEncoding, Encoding: encoding, Offset: 3}
+}
+
+// Bytes returns a pointer to the content of the bitmap. The content
+// is in the native byte order of the host, use Marshal for a portable
+// form.
 func (b *Bitmap) Bytes() []byte {
 	var header = header{
 		magic:       bitmapMagic,
 		encoding:    b.encoding,
-		cardinality: uint16(b.GetCardinality()),
-	}
-	header.write(b.buf)
-	buf := b.buf
-	if b.encoding == encodingArray {
-		buf = buf[:headerSize+len(b.array.content)*2]
+		cardinality: b.headerCardinality(),
 	}
+	buf := b.buf[extHeaderSize-headerSize : b.size()]
+	header.write(buf)
 	return buf
 }
 
-// Marshal returns a binary encoding of the bitmap. The data
-// returned may point to the internals of the bitmap itself,
-// and if the bitmap is subsequently changed the marshaled form
-// may change.
+// Marshal returns a portable binary encoding of the bitmap. The data
+// is a copy, unlike Bytes, whose header shares the storage of the
+// bitmap with the one written by Marshal.
 func (b *Bitmap) Marshal() ([]byte, error) {
-	return b.Bytes(), nil
+	if b.marshalsArray32() {
+		return b.marshalArray32(), nil
+	}
+	dst := make([]byte, b.size())
+	b.portableHeader().writeLE(dst)
+	if littleEndian {
+		copy(dst[extHeaderSize:], b.buf[extHeaderSize:len(dst)])
+		return dst, nil
+	}
+	switch b.encoding {
+	case encodingArray:
+		for i, v := range b.array.content {
+			binary.LittleEndian.PutUint16(dst[extHeaderSize+i*2:], v)
+		}
+	case encodingRun:
+		for i, v := range b.run.content {
+			binary.LittleEndian.PutUint16(dst[extHeaderSize+i*2:], v)
+		}
+	default:
+		for i, v := range b.bitmap.set {
+			binary.LittleEndian.PutUint64(dst[extHeaderSize+i*8:], v)
+		}
+	}
+	return dst, nil
 }
 
-// Bytes returns a pointer to the content of the bitmap.
+// marshalsArray32 returns true if Marshal uses the uint32 array encoding
+// instead of the content of the bitmap.
+func (b *Bitmap) marshalsArray32() bool {
+	return b.wide() && int(b.GetCardinality()) < b.array.sz
+}
+
+// portableHeader returns the version 2 header of the current encoding.
+func (b *Bitmap) portableHeader() header {
+	return header{
+		magic:       bitmapMagic,
+		encoding:    portableEncoding(b.encoding),
+		version:     formatVersion,
+		cardinality: b.headerCardinality(),
+		nbits:       uint32(b.nbits),
+	}
+}
+
+// marshalArray32 returns the array encoding for values that don't fit in a uint16.
+func (b *Bitmap) marshalArray32() []byte {
+	l := int(b.GetCardinality())
+	buf := make([]byte, extHeaderSize+l*4)
+	var header = header{
+		magic:       bitmapMagic,
+		encoding:    encodingArray32LE,
+		version:     formatVersion,
+		cardinality: uint32(l),
+		nbits:       uint32(b.nbits),
+	}
+	header.writeLE(buf)
+	if l > 0 {
+		data := toUint32Slice(buf[extHeaderSize:], l)
+		b.bitmap.nextSetMany32(data)
+		if !littleEndian {
+			for i, v := range data {
+				data[i] = bits.ReverseBytes32(v)
+			}
+		}
+	}
+	return buf
+}
+
+// wide returns true if the values don't fit in a uint16, in which case
+// only the bitmap encoding is used.
+func (b *Bitmap) wide() bool {
+	return b.nbits > array16Bits
+}
+
+// headerCardinality returns the cardinality stored in the header, which
+// is the number of runs for the run encoding.
+func (b *Bitmap) headerCardinality() uint32 {
+	if b.encoding == encodingRun {
+		return uint32(b.run.numRuns())
+	}
+	return uint32(b.GetCardinality())
+}
+
+// size returns the size of the marshaled form.
+func (b *Bitmap) size() int {
+	switch b.encoding {
+	case encodingArray:
+		return extHeaderSize + len(b.array.content)*2
+	case encodingRun:
+		return extHeaderSize + len(b.run.content)*2
+	}
+	return len(b.buf)
+}
+
+// Clone creates a copy of the bitmap.
 func (b *Bitmap) Clone() *Bitmap {
-	c, _ := NewBitmapFromBuf(b.Bytes(), b.nbits, true)
+	c := NewBitmap(b.nbits)
+	c.encoding = b.encoding
+	c.strict = b.strict
+	c.jsonArray = b.jsonArray
+	switch b.encoding {
+	case encodingArray:
+		c.array.content = c.array.content[:len(b.array.content)]
+		copy(c.array.content, b.array.content)
+	case encodingBitmap:
+		copy(c.bitmap.set, b.bitmap.set)
+		c.bitmap.cardinality = b.bitmap.cardinality
+	case encodingRun:
+		c.run.content = c.run.content[:len(b.run.content)]
+		copy(c.run.content, b.run.content)
+		c.run.cardinality = b.run.cardinality
+	}
 	return c
 }
 
 // Add the integer x to the bitmap.
 func (b *Bitmap) Add(v uint32) {
-	if b.encoding == encodingArray {
+	if b.strict && b.outOfRange(v) {
+		return
+	}
+	switch b.encoding {
+	case encodingArray:
 		b.array.add(v)
 		b.convertMaybe()
-	} else {
+	case encodingBitmap:
 		b.bitmap.add(v)
+	case encodingRun:
+		b.run.add(v)
+		b.convertMaybe()
 	}
 }
 
@@ -166,34 +422,124 @@ func (b *Bitmap) AddInt(v int) {
 	b.Add(uint32(v))
 }
 
+// TryAdd adds the integer x to the bitmap, it returns ErrOutOfRange instead
+// of panicking or truncating x when it is not smaller than nbits.
+func (b *Bitmap) TryAdd(v uint32) error {
+	if b.outOfRange(v) {
+		return ErrOutOfRange
+	}
+	b.Add(v)
+	return nil
+}
+
+// TryRemove removes the integer x from the bitmap, it returns ErrOutOfRange
+// instead of panicking or truncating x when it is not smaller than nbits.
+func (b *Bitmap) TryRemove(v uint32) error {
+	if b.outOfRange(v) {
+		return ErrOutOfRange
+	}
+	b.Remove(v)
+	return nil
+}
+
+// outOfRange returns true if the integer doesn't fit in the bitmap.
+func (b *Bitmap) outOfRange(v uint32) bool {
+	return int64(v) >= int64(b.nbits)
+}
+
 // Remove the integer x from the bitmap.
 func (b *Bitmap) Remove(v uint32) {
-	if b.encoding == encodingArray {
+	if b.strict && b.outOfRange(v) {
+		return
+	}
+	switch b.encoding {
+	case encodingArray:
 		b.array.remove(v)
-	} else {
+	case encodingBitmap:
 		b.bitmap.remove(v)
 		b.convertMaybe()
+	case encodingRun:
+		b.run.remove(v)
+		b.convertMaybe()
 	}
 }
 
 // Contains returns true if the integer is contained in the bitmap.
 func (b *Bitmap) Contains(v uint32) bool {
-	if b.encoding == encodingArray {
+	if b.strict && b.outOfRange(v) {
+		return false
+	}
+	switch b.encoding {
+	case encodingArray:
 		return b.array.contains(v)
-	} else {
+	case encodingRun:
+		return b.run.contains(v)
+	default:
 		return b.bitmap.contains(v)
 	}
 }
 
+// Rank returns the number of integers in the bitmap that are smaller or equal to x.
+func (b *Bitmap) Rank(x uint32) uint64 {
+	switch b.encoding {
+	case encodingArray:
+		return uint64(b.array.rank(x))
+	case encodingRun:
+		return uint64(b.run.rank(x))
+	default:
+		return uint64(b.bitmap.rank(x))
+	}
+}
+
+// Select returns the integer at position k (counting from 0) in the sorted
+// integers of the bitmap. It returns false if k is not less than the cardinality.
+func (b *Bitmap) Select(k uint64) (uint32, bool) {
+	if k >= b.GetCardinality() {
+		return 0, false
+	}
+	switch b.encoding {
+	case encodingArray:
+		return uint32(b.array.content[k]), true
+	case encodingRun:
+		return b.run.selectInt(int(k)), true
+	default:
+		return b.bitmap.selectInt(int(k)), true
+	}
+}
+
+// convertMaybe switches to the smallest encoding. Arrays are used below
+// array.sz integers. Above that runs are used if there are less than
+// run.sz of them, they are then always smaller than the bitmap.
 func (b *Bitmap) convertMaybe() {
+	if b.wide() {
+		b.convertEncoding(encodingBitmap)
+		return
+	}
 	switch b.encoding {
 	case encodingArray:
 		if len(b.array.content) >= b.array.sz {
-			b.convertEncoding(encodingBitmap)
+			if numberOfRuns(b.array.content) < b.run.sz {
+				b.convertEncoding(encodingRun)
+			} else {
+				b.convertEncoding(encodingBitmap)
+			}
 		}
 	case encodingBitmap:
 		if b.bitmap.cardinality < b.array.sz {
 			b.convertEncoding(encodingArray)
+		} else if b.bitmap.numberOfRuns(b.run.sz) < b.run.sz {
+			b.convertEncoding(encodingRun)
+		}
+	case encodingRun:
+		nruns := b.run.numRuns()
+		if b.run.cardinality < b.array.sz && b.run.cardinality <= 2*nruns {
+			b.convertEncoding(encodingArray)
+		} else if nruns >= b.run.sz {
+			if b.run.cardinality < b.array.sz {
+				b.convertEncoding(encodingArray)
+			} else {
+				b.convertEncoding(encodingBitmap)
+			}
 		}
 	}
 }
@@ -206,19 +552,30 @@ func (b *Bitmap) And(o *Bitmap) {
 	if b.nbits != o.nbits {
 		return
 	}
+	if b.encoding == encodingRun {
+		b.convertEncoding(encodingBitmap)
+	}
 	if b.encoding == encodingArray {
-		if o.encoding == encodingArray {
+		switch o.encoding {
+		case encodingArray:
 			b.array.and(o.array)
-		} else {
+		case encodingBitmap:
 			b.array.andBitmap(o.bitmap)
+		case encodingRun:
+			b.array.andRun(o.run)
 		}
 	} else {
-		if o.encoding == encodingArray {
-			o.convertEncoding(encodingBitmap)
-			b.bitmap.and(o.bitmap)
-			o.convertMaybe()
-		} else {
+		switch o.encoding {
+		case encodingArray:
+			// The intersection is never larger than the array.
+			content := b.bitmap.andArray(o.array)
+			b.array.content = toUint16Slice(b.buf[extHeaderSize:], len(content))
+			copy(b.array.content, content)
+			b.encoding = encodingArray
+		case encodingBitmap:
 			b.bitmap.and(o.bitmap)
+		case encodingRun:
+			b.bitmap.andRun(o.run)
 		}
 	}
 	b.convertMaybe()
@@ -232,64 +589,297 @@ func (b *Bitmap) Or(o *Bitmap) {
 	if b.nbits != o.nbits {
 		return
 	}
-	if b.encoding == encodingArray {
-		if o.encoding == encodingArray {
-			b.array.or(o.array)
-		} else {
-			b.convertEncoding(encodingBitmap)
-			b.bitmap.or(o.bitmap)
-		}
+	if b.encoding == encodingArray && o.encoding == encodingArray {
+		b.array.or(o.array)
 		b.convertMaybe()
-	} else {
-		if o.encoding == encodingArray {
-			for _, v := range o.array.content {
-				b.Add(uint32(v))
-			}
-		} else {
-			b.bitmap.or(o.bitmap)
+		return
+	}
+	b.convertEncoding(encodingBitmap)
+	switch o.encoding {
+	case encodingArray:
+		for _, v := range o.array.content {
+			b.bitmap.add(uint32(v))
 		}
+	case encodingBitmap:
+		b.bitmap.or(o.bitmap)
+	case encodingRun:
+		b.bitmap.orRun(o.run)
 	}
+	b.convertMaybe()
 }
 
-// Or computes the union between two bitmaps and stores the result in the current bitmap.
+// AndNot computes the difference between two bitmaps and stores the result in the current bitmap.
 func (b *Bitmap) AndNot(o *Bitmap) {
+	if o == nil {
+		return
+	}
 	if b.nbits != o.nbits {
 		return
 	}
+	if b.encoding == encodingRun {
+		b.convertEncoding(encodingBitmap)
+	}
 	if b.encoding == encodingArray {
-		if o.encoding == encodingArray {
+		switch o.encoding {
+		case encodingArray:
 			b.array.andNot(o.array)
-		} else {
+		case encodingBitmap:
 			b.array.andNotBitmap(o.bitmap)
+		case encodingRun:
+			b.array.andNotRun(o.run)
 		}
 	} else {
-		if o.encoding == encodingArray {
+		switch o.encoding {
+		case encodingArray:
 			b.bitmap.andNotArray(o.array)
-		} else {
+		case encodingBitmap:
 			b.bitmap.andNot(o.bitmap)
+		case encodingRun:
+			b.bitmap.andNotRun(o.run)
 		}
 	}
 	b.convertMaybe()
 }
 
+// Xor computes the symmetric difference between two bitmaps and stores the result in the current bitmap.
+func (b *Bitmap) Xor(o *Bitmap) {
+	if o == nil {
+		return
+	}
+	if b.nbits != o.nbits {
+		return
+	}
+	if b == o {
+		b.encoding = encodingArray
+		b.array.content = b.array.content[:0]
+		b.convertMaybe()
+		return
+	}
+	if b.encoding == encodingArray && o.encoding == encodingArray {
+		b.array.xor(o.array)
+		b.convertMaybe()
+		return
+	}
+	b.convertEncoding(encodingBitmap)
+	switch o.encoding {
+	case encodingArray:
+		b.bitmap.xorArray(o.array)
+	case encodingBitmap:
+		b.bitmap.xor(o.bitmap)
+	case encodingRun:
+		b.bitmap.xorRun(o.run)
+	}
+	b.convertMaybe()
+}
+
+// AndCardinality returns the cardinality of the intersection between two bitmaps, neither bitmap is modified.
+func (b *Bitmap) AndCardinality(o *Bitmap) uint64 {
+	switch b.encoding {
+	case encodingArray:
+		switch o.encoding {
+		case encodingArray:
+			return uint64(b.array.andCardinality(o.array))
+		case encodingBitmap:
+			return uint64(b.array.andCardinalityBitmap(o.bitmap))
+		case encodingRun:
+			return uint64(o.run.andCardinalityArray(b.array))
+		}
+	case encodingBitmap:
+		switch o.encoding {
+		case encodingArray:
+			return uint64(o.array.andCardinalityBitmap(b.bitmap))
+		case encodingBitmap:
+			return uint64(b.bitmap.andCardinality(o.bitmap))
+		case encodingRun:
+			return uint64(o.run.andCardinalityBitmap(b.bitmap))
+		}
+	case encodingRun:
+		switch o.encoding {
+		case encodingArray:
+			return uint64(b.run.andCardinalityArray(o.array))
+		case encodingBitmap:
+			return uint64(b.run.andCardinalityBitmap(o.bitmap))
+		case encodingRun:
+			return uint64(b.run.andCardinality(o.run))
+		}
+	}
+	return 0
+}
+
+// OrCardinality returns the cardinality of the union between two bitmaps, neither bitmap is modified.
+func (b *Bitmap) OrCardinality(o *Bitmap) uint64 {
+	return b.GetCardinality() + o.GetCardinality() - b.AndCardinality(o)
+}
+
+// AndNotCardinality returns the cardinality of the difference between two bitmaps, neither bitmap is modified.
+func (b *Bitmap) AndNotCardinality(o *Bitmap) uint64 {
+	return b.GetCardinality() - b.AndCardinality(o)
+}
+
+// XorCardinality returns the cardinality of the symmetric difference between two bitmaps, neither bitmap is modified.
+func (b *Bitmap) XorCardinality(o *Bitmap) uint64 {
+	return b.GetCardinality() + o.GetCardinality() - 2*b.AndCardinality(o)
+}
+
+// Intersects returns true if the two bitmaps have at least one integer in common.
+func (b *Bitmap) Intersects(o *Bitmap) bool {
+	switch b.encoding {
+	case encodingArray:
+		switch o.encoding {
+		case encodingArray:
+			return b.array.intersects(o.array)
+		case encodingBitmap:
+			return b.array.intersectsBitmap(o.bitmap)
+		case encodingRun:
+			return o.run.intersectsArray(b.array)
+		}
+	case encodingBitmap:
+		switch o.encoding {
+		case encodingArray:
+			return o.array.intersectsBitmap(b.bitmap)
+		case encodingBitmap:
+			return b.bitmap.intersects(o.bitmap)
+		case encodingRun:
+			return o.run.intersectsBitmap(b.bitmap)
+		}
+	case encodingRun:
+		switch o.encoding {
+		case encodingArray:
+			return b.run.intersectsArray(o.array)
+		case encodingBitmap:
+			return b.run.intersectsBitmap(o.bitmap)
+		case encodingRun:
+			return b.run.intersects(o.run)
+		}
+	}
+	return false
+}
+
 // Flip negates the bits in the given range (i.e., [start,stop)), any integer present in this
 // range and in the bitmap is removed, and any integer present in the range and not in the bitmap is added.
 func (b *Bitmap) FlipInt(start, stop int) {
+	start, stop = b.clampRange(start, stop)
 	if start >= stop {
 		return
 	}
-	if start < 0 {
-		start = 0
+	b.convertEncoding(encodingBitmap)
+
+	b.bitmap.flip(start, stop)
+	b.convertMaybe()
+}
+
+// AddRange adds the integers in the given range (i.e., [start,stop)) to the bitmap.
+// An array is only converted when the range makes it too large.
+func (b *Bitmap) AddRange(start, stop int) {
+	start, stop = b.clampRange(start, stop)
+	if start >= stop {
+		return
 	}
-	if stop >= b.nbits {
-		stop = b.nbits - 1
+	switch b.encoding {
+	case encodingArray:
+		present := b.array.lowerBound(stop) - b.array.lowerBound(start)
+		if len(b.array.content)+stop-start-present < b.array.sz {
+			b.array.addRange(start, stop)
+			return
+		}
+		b.convertEncoding(encodingRun)
+		b.run.addRange(start, stop)
+	case encodingBitmap:
+		b.bitmap.cardinality += stop - start - b.bitmap.cardinalityInRange(start, stop)
+		b.bitmap.setRange(start, stop)
+	case encodingRun:
+		b.run.addRange(start, stop)
 	}
-	if b.encoding == encodingArray {
-		b.convertEncoding(encodingBitmap)
+	b.convertMaybe()
+}
+
+// RemoveRange removes the integers in the given range (i.e., [start,stop)) from the bitmap.
+func (b *Bitmap) RemoveRange(start, stop int) {
+	start, stop = b.clampRange(start, stop)
+	if start >= stop {
+		return
 	}
+	switch b.encoding {
+	case encodingArray:
+		b.array.removeRange(start, stop)
+	case encodingBitmap:
+		b.bitmap.cardinality -= b.bitmap.cardinalityInRange(start, stop)
+		b.bitmap.clearRange(start, stop)
+		b.convertMaybe()
+	case encodingRun:
+		b.run.removeRange(start, stop)
+		b.convertMaybe()
+	}
+}
 
-	b.bitmap.flip(start, stop)
-	b.convertMaybe()
+// CardinalityInRange returns the number of integers of the bitmap in the range [start,stop).
+func (b *Bitmap) CardinalityInRange(start, stop int) uint64 {
+	start, stop = b.clampRange(start, stop)
+	if start >= stop {
+		return 0
+	}
+	switch b.encoding {
+	case encodingArray:
+		return uint64(b.array.lowerBound(stop) - b.array.lowerBound(start))
+	case encodingRun:
+		return uint64(b.run.cardinalityInRange(start, stop))
+	}
+	return uint64(b.bitmap.cardinalityInRange(start, stop))
+}
+
+// ContainsAnyInRange returns true if an integer of the range [start,stop) is in the bitmap.
+func (b *Bitmap) ContainsAnyInRange(start, stop int) bool {
+	start, stop = b.clampRange(start, stop)
+	if start >= stop {
+		return false
+	}
+	switch b.encoding {
+	case encodingArray:
+		return b.array.lowerBound(stop) > b.array.lowerBound(start)
+	case encodingRun:
+		i := b.run.search(stop - 1)
+		return i >= 0 && b.run.last(i) >= start
+	}
+	return b.bitmap.containsAnyInRange(start, stop)
+}
+
+// ContainsAllInRange returns true if all the integers of the range [start,stop) are in the bitmap.
+func (b *Bitmap) ContainsAllInRange(start, stop int) bool {
+	if start >= stop {
+		return true
+	}
+	if start < 0 || stop > b.nbits {
+		return false
+	}
+	switch b.encoding {
+	case encodingArray:
+		return b.array.lowerBound(stop)-b.array.lowerBound(start) == stop-start
+	case encodingRun:
+		return b.run.containsAllInRange(start, stop)
+	}
+	return b.bitmap.containsAllInRange(start, stop)
+}
+
+// ToArrayInRange returns the integers of the bitmap in the range [start,stop) in sorted order.
+func (b *Bitmap) ToArrayInRange(start, stop int) []uint32 {
+	n := int(b.CardinalityInRange(start, stop))
+	if n == 0 {
+		return []uint32{}
+	}
+	start, _ = b.clampRange(start, stop)
+	values, _ := b.NextMany(uint32(start), make([]uint32, 0, n), n)
+	return values
+}
+
+// clampRange restricts the range [start,stop) to the capacity of the bitmap.
+func (b *Bitmap) clampRange(start, stop int) (int, int) {
+	if start < 0 {
+		start = 0
+	}
+	if stop > b.nbits {
+		stop = b.nbits
+	}
+	return start, stop
 }
 
 // Equals returns true if the two bitmaps are the same, false otherwise.
@@ -309,27 +899,46 @@ func (b *Bitmap) Equals(o *Bitmap) bool {
 	if b.GetCardinality() != o.GetCardinality() {
 		return false
 	}
-	if b.encoding == encodingArray {
-		if o.encoding == encodingArray {
+	switch b.encoding {
+	case encodingArray:
+		switch o.encoding {
+		case encodingArray:
 			return b.array.equals(o.array)
-		} else {
+		case encodingBitmap:
 			return b.array.equalsBitmap(o.bitmap)
+		case encodingRun:
+			return o.run.equalsArray(b.array)
 		}
-	} else {
-		if o.encoding == encodingArray {
+	case encodingBitmap:
+		switch o.encoding {
+		case encodingArray:
 			return b.bitmap.equalsArray(o.array)
-		} else {
+		case encodingBitmap:
 			return b.bitmap.equals(o.bitmap)
+		case encodingRun:
+			return o.run.equalsBitmap(b.bitmap)
+		}
+	case encodingRun:
+		switch o.encoding {
+		case encodingArray:
+			return b.run.equalsArray(o.array)
+		case encodingBitmap:
+			return b.run.equalsBitmap(o.bitmap)
+		case encodingRun:
+			return b.run.equals(o.run)
 		}
 	}
-	return true
+	return false
 }
 
 // GetCardinality returns the number of integers contained in the bitmap.
 func (b *Bitmap) GetCardinality() uint64 {
-	if b.encoding == encodingArray {
+	switch b.encoding {
+	case encodingArray:
 		return uint64(len(b.array.content))
-	} else {
+	case encodingRun:
+		return uint64(b.run.cardinality)
+	default:
 		return uint64(b.bitmap.cardinality)
 	}
 }
@@ -339,12 +948,19 @@ func (b *Bitmap) convertEncoding(encoding byte) {
 		return
 	}
 	data := make([]uint16, b.GetCardinality())
-	if encoding == encodingArray {
+	switch b.encoding {
+	case encodingArray:
+		copy(data, b.array.content)
+	case encodingBitmap:
 		b.bitmap.nextSetMany16(data)
-		b.array.content = toUint16Slice(b.buf[headerSize:], len(data))
+	case encodingRun:
+		b.run.nextSetMany16(data)
+	}
+	switch encoding {
+	case encodingArray:
+		b.array.content = toUint16Slice(b.buf[extHeaderSize:], len(data))
 		copy(b.array.content, data)
-	} else {
-		copy(data, b.array.content)
+	case encodingBitmap:
 		// Clear memory (must clear the bitmap).
 		for i := 0; i < len(b.buf); i++ {
 			b.buf[i] = 0
@@ -353,6 +969,8 @@ func (b *Bitmap) convertEncoding(encoding byte) {
 		for _, v := range data {
 			b.bitmap.add(uint32(v))
 		}
+	case encodingRun:
+		b.run.fromSorted(data)
 	}
 	b.encoding = encoding
 }
@@ -362,19 +980,96 @@ func (b *Bitmap) IsEmpty() bool {
 	return b.GetCardinality() == 0
 }
 
+// Minimum returns the smallest integer in the bitmap, or false if it is empty.
+func (b *Bitmap) Minimum() (uint32, bool) {
+	if b.IsEmpty() {
+		return 0, false
+	}
+	switch b.encoding {
+	case encodingArray:
+		return uint32(b.array.content[0]), true
+	case encodingRun:
+		return uint32(b.run.start(0)), true
+	}
+	return b.bitmap.minimum(), true
+}
+
+// Maximum returns the largest integer in the bitmap, or false if it is empty.
+func (b *Bitmap) Maximum() (uint32, bool) {
+	if b.IsEmpty() {
+		return 0, false
+	}
+	switch b.encoding {
+	case encodingArray:
+		return uint32(b.array.content[len(b.array.content)-1]), true
+	case encodingRun:
+		return uint32(b.run.last(b.run.numRuns() - 1)), true
+	}
+	return b.bitmap.maximum(), true
+}
+
 // ToArray creates a new slice containing all of the integers stored in the Bitmap in sorted order
 func (b *Bitmap) ToArray() []uint32 {
 	indices := make([]uint32, b.GetCardinality())
-	if b.encoding == encodingArray {
+	switch b.encoding {
+	case encodingArray:
 		for i, v := range b.array.content {
 			indices[i] = uint32(v)
 		}
-	} else {
+	case encodingBitmap:
 		b.bitmap.nextSetMany32(indices)
+	case encodingRun:
+		b.run.nextSetMany32(indices)
 	}
 	return indices
 }
 
+// NextMany appends many next bit sets from the specified index,
+// including possibly the current index and up to limit.
+// If more is true, there are additional bits to be added.
+//
+// The bits can be paged through as follows:
+//
+//	buf := make([]uint32, 0, 10)
+//	j := uint32(0)
+//	for {
+//		var more bool
+//		buf, more = v.NextMany(j, buf[:0], 10)
+//		// do something with buf
+//		if !more {
+//			break
+//		}
+//		j = buf[len(buf)-1] + 1
+//	}
+func (b *Bitmap) NextMany(i uint32, buffer []uint32, limit int) ([]uint32, bool) {
+	if limit == 0 {
+		return buffer, false
+	}
+	switch b.encoding {
+	case encodingArray:
+		return b.array.nextMany(i, buffer, limit)
+	case encodingRun:
+		return b.run.nextMany(i, buffer, limit)
+	}
+	return b.bitmap.nextMany(i, buffer, limit)
+}
+
+// PrevMany appends many previous bit sets from the specified index,
+// including possibly the current index and down to limit, in decreasing
+// order. If more is true, there are additional bits to be added.
+func (b *Bitmap) PrevMany(i uint32, buffer []uint32, limit int) ([]uint32, bool) {
+	if limit == 0 {
+		return buffer, false
+	}
+	switch b.encoding {
+	case encodingArray:
+		return b.array.prevMany(i, buffer, limit)
+	case encodingRun:
+		return b.run.prevMany(i, buffer, limit)
+	}
+	return b.bitmap.prevMany(i, buffer, limit)
+}
+
 // And computes the intersection between the bitmaps and returns the result.
 func AndBitmaps(nbits int, bitmaps ...*Bitmap) *Bitmap {
 	if len(bitmaps) == 0 {
@@ -399,6 +1094,18 @@ func OrBitmaps(nbits int, bitmaps ...*Bitmap) *Bitmap {
 	return b
 }
 
+// XorBitmaps computes the symmetric difference between the bitmaps and returns the result.
+func XorBitmaps(nbits int, bitmaps ...*Bitmap) *Bitmap {
+	if len(bitmaps) == 0 {
+		return NewBitmap(nbits)
+	}
+	b := bitmaps[0].Clone()
+	for _, o := range bitmaps[1:] {
+		b.Xor(o)
+	}
+	return b
+}
+
 // AndNot computes the difference between the bitmaps and returns the result.
 func AndNotBitmap(a *Bitmap, b *Bitmap) *Bitmap {
 	c := a.Clone()
@@ -414,25 +1121,122 @@ func FlipBitmap(b *Bitmap, start, stop int) *Bitmap {
 }
 
 // Data encoding.
-// 64 bit header.
+// 64 bit header for the legacy encodings and version 1:
+// magic uint32 | encoding uint8 | version uint8 | cardinality uint16
+// 128 bit header from version 2:
+// magic uint32 | encoding uint8 | version uint8 | flags uint16 | cardinality uint32 | nbits uint32
 type header struct {
 	magic       uint32 // magic uint32
 	encoding    byte   // encoding uint8
-	unused      byte   // unused uint8
-	cardinality uint16 // cardinality uint16
+	version     byte   // version uint8, unused by the legacy encodings
+	flags       uint16 // flags, from version 2
+	cardinality uint32 // cardinality, only 16 bits before version 2
+	nbits       uint32 // nbits, from version 2
 }
 
 func (h *header) read(buf []byte) {
-	data := toUint64Slice(buf)
-	v := data[0]
+	v := binary.LittleEndian.Uint64(buf)
+	if uint32(v>>32) != bitmapMagic {
+		// Legacy headers are in the byte order of the host that wrote them.
+		v = toUint64Slice(buf)[0]
+	}
 	h.magic = uint32((v & 0xFFFFFFFF00000000) >> 32)
 	h.encoding = byte((v & 0xFF000000) >> 24)
-	h.cardinality = uint16(v & 0xFFFF)
+	h.version = byte((v & 0xFF0000) >> 16)
+	h.cardinality = uint32(v & 0xFFFF)
+	if h.version >= 2 {
+		h.flags = uint16(v)
+	}
+}
+
+// readExt reads the second half of a version 2 header.
+func (h *header) readExt(buf []byte) {
+	h.cardinality = binary.LittleEndian.Uint32(buf[8:])
+	h.nbits = binary.LittleEndian.Uint32(buf[12:])
 }
 
+// write writes a legacy header in the byte order of the host.
 func (h header) write(buf []byte) {
 	data := toUint64Slice(buf)
-	data[0] = uint64(h.magic)<<32 | uint64(h.encoding)<<24 | uint64(h.cardinality)
+	data[0] = h.value()
+}
+
+// writeLE writes a version 2 header.
+func (h header) writeLE(buf []byte) {
+	binary.LittleEndian.PutUint64(buf, h.value())
+	binary.LittleEndian.PutUint32(buf[8:], h.cardinality)
+	binary.LittleEndian.PutUint32(buf[12:], h.nbits)
+}
+
+func (h header) value() uint64 {
+	v := uint64(h.magic)<<32 | uint64(h.encoding)<<24 | uint64(h.version)<<16
+	if h.version < 2 {
+		v |= uint64(uint16(h.cardinality))
+	} else {
+		v |= uint64(h.flags)
+	}
+	return v
+}
+
+// littleEndian is true if the host is little-endian, in which case the
+// portable encodings have the same layout as the legacy ones.
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// legacyEncoding returns the native encoding matching a portable encoding.
+func legacyEncoding(encoding byte) byte {
+	switch encoding {
+	case encodingBitmapLE:
+		return encodingBitmap
+	case encodingArrayLE:
+		return encodingArray
+	case encodingRunLE:
+		return encodingRun
+	}
+	return encoding
+}
+
+// portableEncoding returns the portable encoding matching a native encoding.
+func portableEncoding(encoding byte) byte {
+	switch encoding {
+	case encodingBitmap:
+		return encodingBitmapLE
+	case encodingArray:
+		return encodingArrayLE
+	case encodingRun:
+		return encodingRunLE
+	}
+	return encoding
+}
+
+// toNativeEndian returns a copy of a portably encoded buffer with the
+// data converted to the byte order of the host.
+func toNativeEndian(buf []byte, encoding byte, hsize int) []byte {
+	dst := make([]byte, len(buf))
+	copy(dst[:hsize], buf)
+	if len(buf) == hsize {
+		return dst
+	}
+	switch encoding {
+	case encodingBitmapLE:
+		data := toUint64Slice(dst[hsize:])
+		for i := range data {
+			data[i] = binary.LittleEndian.Uint64(buf[hsize+i*8:])
+		}
+	case encodingArrayLE, encodingRunLE:
+		data := toUint16Slice(dst[hsize:], (len(buf)-hsize)/2)
+		for i := range data {
+			data[i] = binary.LittleEndian.Uint16(buf[hsize+i*2:])
+		}
+	case encodingArray32LE:
+		data := toUint32Slice(dst[hsize:], (len(buf)-hsize)/4)
+		for i := range data {
+			data[i] = binary.LittleEndian.Uint32(buf[hsize+i*4:])
+		}
+	}
+	return dst
 }
 
 func toUint64Slice(b []byte) []uint64 {
@@ -444,6 +1248,15 @@ func toUint64Slice(b []byte) []uint64 {
 	return u64s
 }
 
+func toUint32Slice(b []byte, l int) []uint32 {
+	var u32s []uint32
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&u32s))
+	hdr.Len = l
+	hdr.Cap = len(b) / 4
+	hdr.Data = uintptr(unsafe.Pointer(&b[0]))
+	return u32s
+}
+
 func toUint16Slice(b []byte, l int) []uint16 {
 	var u16s []uint16
 	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&u16s))
@@ -458,5 +1271,5 @@ func bodySize(nbits int) int {
 }
 
 func totalSize(nbits int) int {
-	return headerSize + bodySize(nbits)
+	return extHeaderSize + bodySize(nbits)
 }
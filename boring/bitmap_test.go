@@ -1,8 +1,18 @@
 package boring
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"testing/iotest"
 )
 
 var nbits = 30000
@@ -63,6 +73,40 @@ func TestOrShort(t *testing.T) {
 	}
 }
 
+func TestArrayOr(t *testing.T) {
+	a := NewBitmap(nbits)
+	o := NewBitmap(nbits)
+	for _, v := range []uint32{1, 3, 5, 7} {
+		a.Add(v)
+	}
+	for _, v := range []uint32{0, 3, 4, 8, 9} {
+		o.Add(v)
+	}
+	a.array.or(o.array)
+	if !reflect.DeepEqual(a.array.content, []uint16{0, 1, 3, 4, 5, 7, 8, 9}) {
+		t.Error("Unexpected value: ", a.array.content)
+	}
+	if !reflect.DeepEqual(o.array.content, []uint16{0, 3, 4, 8, 9}) {
+		t.Error("the argument should not change: ", o.array.content)
+	}
+}
+
+func TestArrayAndNotBitmap(t *testing.T) {
+	a := NewBitmap(nbits)
+	o := NewBitmap(nbits)
+	for _, v := range []uint32{1, 2, 3, 100, 20000} {
+		a.Add(v)
+	}
+	for _, v := range []uint32{2, 100, 101} {
+		o.Add(v)
+	}
+	o.convertEncoding(encodingBitmap)
+	a.array.andNotBitmap(o.bitmap)
+	if !reflect.DeepEqual(a.array.content, []uint16{1, 3, 20000}) {
+		t.Error("Unexpected value: ", a.array.content)
+	}
+}
+
 func TestEquals(t *testing.T) {
 	a := NewBitmap(nbits)
 	c := NewBitmap(nbits)
@@ -265,6 +309,358 @@ func TestAndNot(t *testing.T) {
 	}
 }
 
+func TestXorBitmaps(t *testing.T) {
+	a := NewBitmap(nbits)
+	b := NewBitmap(nbits)
+	for i := uint32(0); i < 100; i++ {
+		a.Add(i)
+	}
+	for i := uint32(50); i < 250; i++ {
+		b.Add(i)
+	}
+	c := XorBitmaps(nbits, a, b)
+	d := XorBitmaps(nbits, b, a)
+	if c.GetCardinality() != 200 {
+		t.Errorf("Symmetric difference should have 200 bits set, but had %d", c.GetCardinality())
+	}
+	if !c.Equals(d) {
+		t.Errorf("Symmetric difference should be symmetric")
+	}
+	e := XorBitmaps(nbits, a, b, a)
+	if !e.Equals(b) {
+		t.Errorf("Symmetric difference should be its own inverse")
+	}
+}
+
+func TestXor(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		na, nb uint32
+	}{
+		{"small", 40, 60},
+		{"mixed", 40, 400},
+		{"large", 400, 600},
+	} {
+		a := NewBitmap(nbits)
+		b := NewBitmap(nbits)
+		for i := uint32(0); i < tc.na; i++ {
+			a.Add(i * 3)
+		}
+		for i := uint32(0); i < tc.nb; i++ {
+			b.Add(i * 2)
+		}
+		expected := []uint32{}
+		for v := uint32(0); v < uint32(nbits); v++ {
+			if a.Contains(v) != b.Contains(v) {
+				expected = append(expected, v)
+			}
+		}
+		c := a.Clone()
+		c.Xor(b)
+		d := b.Clone()
+		d.Xor(a)
+		if !reflect.DeepEqual(c.ToArray(), expected) {
+			t.Errorf("%s: unexpected value: %v", tc.name, c.ToArray())
+		}
+		if !c.Equals(d) {
+			t.Errorf("%s: symmetric difference should be symmetric", tc.name)
+		}
+		if c.GetCardinality() != uint64(len(expected)) {
+			t.Errorf("%s: unexpected cardinality %d", tc.name, c.GetCardinality())
+		}
+		c.Xor(c)
+		if !c.IsEmpty() {
+			t.Errorf("%s: bitmap should be empty", tc.name)
+		}
+	}
+}
+
+func TestRankSelect(t *testing.T) {
+	for _, step := range []uint32{1000, 7} {
+		b := NewBitmap(nbits)
+		for v := uint32(5); v < uint32(nbits); v += step {
+			b.Add(v)
+		}
+		arr := b.ToArray()
+		for k, v := range arr {
+			if r := b.Rank(v); r != uint64(k+1) {
+				t.Errorf("Rank(%d) should be %d, but was %d", v, k+1, r)
+				return
+			}
+			if r := b.Rank(v - 1); r != uint64(k) {
+				t.Errorf("Rank(%d) should be %d, but was %d", v-1, k, r)
+				return
+			}
+			if s, ok := b.Select(uint64(k)); !ok || s != v {
+				t.Errorf("Select(%d) should be %d, but was %d", k, v, s)
+				return
+			}
+		}
+		if b.Rank(0) != 0 {
+			t.Error("Rank(0) should be 0")
+		}
+		if b.Rank(1<<20) != b.GetCardinality() {
+			t.Error("Rank past the end should be the cardinality")
+		}
+		if _, ok := b.Select(b.GetCardinality()); ok {
+			t.Error("Select past the cardinality should fail")
+		}
+	}
+}
+
+func TestCardinalityOps(t *testing.T) {
+	// 40 and 400 values are respectively array and bitmap encoded.
+	for _, tc := range []struct {
+		name   string
+		na, nb uint32
+	}{
+		{"array/array", 40, 60},
+		{"array/bitmap", 40, 400},
+		{"bitmap/array", 400, 40},
+		{"bitmap/bitmap", 400, 600},
+	} {
+		a := NewBitmap(nbits)
+		b := NewBitmap(nbits)
+		for i := uint32(0); i < tc.na; i++ {
+			a.Add(i * 3)
+		}
+		for i := uint32(0); i < tc.nb; i++ {
+			b.Add(i * 2)
+		}
+		aenc, benc := a.encoding, b.encoding
+		aarr, barr := a.ToArray(), b.ToArray()
+
+		and := AndBitmaps(nbits, a, b)
+		or := OrBitmaps(nbits, a, b)
+		andNot := AndNotBitmap(a, b)
+		xor := XorBitmaps(nbits, a, b)
+		if c := a.AndCardinality(b); c != and.GetCardinality() {
+			t.Errorf("%s: intersection should have %d bits set, but had %d", tc.name, and.GetCardinality(), c)
+		}
+		if c := a.OrCardinality(b); c != or.GetCardinality() {
+			t.Errorf("%s: union should have %d bits set, but had %d", tc.name, or.GetCardinality(), c)
+		}
+		if c := a.AndNotCardinality(b); c != andNot.GetCardinality() {
+			t.Errorf("%s: difference should have %d bits set, but had %d", tc.name, andNot.GetCardinality(), c)
+		}
+		if c := a.XorCardinality(b); c != xor.GetCardinality() {
+			t.Errorf("%s: symmetric difference should have %d bits set, but had %d", tc.name, xor.GetCardinality(), c)
+		}
+		if !a.Intersects(b) {
+			t.Errorf("%s: bitmaps should intersect", tc.name)
+		}
+		if a.Intersects(andNot) == andNot.IsEmpty() {
+			t.Errorf("%s: a should intersect a-b", tc.name)
+		}
+		if b.Intersects(andNot) {
+			t.Errorf("%s: b should not intersect a-b", tc.name)
+		}
+		if a.encoding != aenc || b.encoding != benc {
+			t.Errorf("%s: encodings should not change", tc.name)
+		}
+		if !reflect.DeepEqual(a.ToArray(), aarr) || !reflect.DeepEqual(b.ToArray(), barr) {
+			t.Errorf("%s: bitmaps should not be modified", tc.name)
+		}
+	}
+}
+
+// TestSharedOperand runs the binary operations concurrently against the
+// same argument, run with -race to check it is never written to.
+func TestSharedOperand(t *testing.T) {
+	for _, n := range []uint32{40, 400} {
+		shared := NewBitmap(nbits)
+		for i := uint32(0); i < n; i++ {
+			shared.Add(i * 3)
+		}
+		expected := shared.ToArray()
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				b := NewBitmap(nbits)
+				// Alternate between array and bitmap receivers.
+				for i := uint32(0); i < uint32(40+g%2*400); i++ {
+					b.Add(i * 2)
+				}
+				for i := 0; i < 20; i++ {
+					c := b.Clone()
+					c.And(shared)
+					c = b.Clone()
+					c.Or(shared)
+					c = b.Clone()
+					c.AndNot(shared)
+					c = b.Clone()
+					c.Xor(shared)
+					b.AndCardinality(shared)
+					b.Intersects(shared)
+					b.Equals(shared)
+					shared.Clone()
+				}
+			}(g)
+		}
+		wg.Wait()
+		if !reflect.DeepEqual(shared.ToArray(), expected) {
+			t.Error("shared operand should not be modified")
+		}
+	}
+}
+
+func TestRunEncoding(t *testing.T) {
+	b := NewBitmap(nbits)
+	b.FlipInt(100, 5000)
+	b.FlipInt(6000, 9000)
+	if b.encoding != encodingRun {
+		t.Error("Unexpected encoding: ", b.encoding)
+		return
+	}
+	if b.GetCardinality() != 7900 {
+		t.Error("Unexpected cardinality: ", b.GetCardinality())
+		return
+	}
+	if !b.Contains(100) || !b.Contains(4999) || b.Contains(5000) || b.Contains(99) {
+		t.Error("Unexpected content")
+	}
+	if r := b.Rank(6000); r != 4901 {
+		t.Error("Unexpected rank: ", r)
+	}
+	if v, ok := b.Select(4900); !ok || v != 6000 {
+		t.Error("Unexpected select: ", v)
+	}
+
+	// Split and merge runs.
+	b.Remove(200)
+	b.Remove(100)
+	b.Remove(8999)
+	b.Add(5000)
+	b.Add(5002)
+	b.Add(5001)
+	if b.encoding != encodingRun {
+		t.Error("Unexpected encoding: ", b.encoding)
+		return
+	}
+	if !reflect.DeepEqual(b.run.content, []uint16{101, 98, 201, 4801, 6000, 2998}) {
+		t.Error("Unexpected runs: ", b.run.content)
+	}
+	if b.GetCardinality() != 7900 {
+		t.Error("Unexpected cardinality: ", b.GetCardinality())
+	}
+
+	buf, err := b.Marshal()
+	if err != nil {
+		t.Error("Error marshalling: ", err)
+		return
+	}
+	if len(buf) != extHeaderSize+3*4 {
+		t.Error("Unexpected size: ", len(buf))
+	}
+	b1, err := NewBitmapFromBuf(buf, nbits, true)
+	if err != nil {
+		t.Error("Error unmarshalling: ", err)
+		return
+	}
+	if b1.encoding != encodingRun || !b1.Equals(b) {
+		t.Error("bitmaps should be equal")
+	}
+
+	// Too many runs switch to a bitmap.
+	for v := uint32(10000); v < 20000; v += 2 {
+		b.Add(v)
+	}
+	if b.encoding != encodingBitmap {
+		t.Error("Unexpected encoding: ", b.encoding)
+	}
+	b.FlipInt(10000, 20000)
+	b.FlipInt(10000, 20000)
+	b.AndNot(XorBitmaps(nbits, b, b1))
+	if b.encoding != encodingRun || !b.Equals(b1) {
+		t.Error("Unexpected encoding: ", b.encoding)
+	}
+}
+
+func TestRunOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	newOperands := func() []*Bitmap {
+		array := NewBitmap(nbits)
+		for i := 0; i < 50; i++ {
+			array.Add(uint32(r.Intn(nbits)))
+		}
+		bitmap := NewBitmap(nbits)
+		for i := 0; i < 5000; i++ {
+			bitmap.Add(uint32(r.Intn(nbits)))
+		}
+		run := NewBitmap(nbits)
+		for i := 0; i < 10; i++ {
+			start := r.Intn(nbits)
+			run.FlipInt(start, start+r.Intn(1000))
+		}
+		if array.encoding != encodingArray || bitmap.encoding != encodingBitmap || run.encoding != encodingRun {
+			t.Fatal("Unexpected encodings")
+		}
+		return []*Bitmap{array, bitmap, run}
+	}
+	for i := 0; i < 10; i++ {
+		for _, a := range newOperands() {
+			for _, b := range newOperands() {
+				aarr, barr := a.ToArray(), b.ToArray()
+				var and, or, andNot, xor []uint32
+				for v := uint32(0); v < uint32(nbits); v++ {
+					switch {
+					case a.Contains(v) && b.Contains(v):
+						and = append(and, v)
+						or = append(or, v)
+					case a.Contains(v):
+						or = append(or, v)
+						andNot = append(andNot, v)
+						xor = append(xor, v)
+					case b.Contains(v):
+						or = append(or, v)
+						xor = append(xor, v)
+					}
+				}
+				for _, tc := range []struct {
+					name     string
+					result   *Bitmap
+					expected []uint32
+				}{
+					{"and", AndBitmaps(nbits, a, b), and},
+					{"or", OrBitmaps(nbits, a, b), or},
+					{"andNot", AndNotBitmap(a, b), andNot},
+					{"xor", XorBitmaps(nbits, a, b), xor},
+				} {
+					if tc.expected == nil {
+						tc.expected = []uint32{}
+					}
+					if !reflect.DeepEqual(tc.result.ToArray(), tc.expected) {
+						t.Errorf("%s of %x and %x: unexpected result", tc.name, a.encoding, b.encoding)
+					}
+					if tc.result.GetCardinality() != uint64(len(tc.expected)) {
+						t.Errorf("%s of %x and %x: unexpected cardinality", tc.name, a.encoding, b.encoding)
+					}
+				}
+				if c := a.AndCardinality(b); c != uint64(len(and)) {
+					t.Errorf("%x and %x: intersection should have %d bits set, but had %d", a.encoding, b.encoding, len(and), c)
+				}
+				if a.Intersects(b) != (len(and) > 0) {
+					t.Errorf("%x and %x: Intersects should be %v", a.encoding, b.encoding, len(and) > 0)
+				}
+				if !a.Equals(a.Clone()) || a.Equals(b) {
+					t.Errorf("%x and %x: Equals failed", a.encoding, b.encoding)
+				}
+				c := NewBitmap(nbits)
+				c.Or(a)
+				if !c.Equals(a) || !a.Equals(c) {
+					t.Errorf("%x and %x: Equals failed", a.encoding, c.encoding)
+				}
+				if !reflect.DeepEqual(a.ToArray(), aarr) || !reflect.DeepEqual(b.ToArray(), barr) {
+					t.Errorf("%x and %x: operands should not change", a.encoding, b.encoding)
+				}
+			}
+		}
+	}
+}
+
 func TestFlipRange(t *testing.T) {
 	b := NewBitmap(nbits)
 	for _, v := range []uint32{1, 3, 5, 7, 9, 11, 13, 15} {
@@ -285,6 +681,29 @@ func TestFlipRange(t *testing.T) {
 	}
 }
 
+func TestBytesAndMarshal(t *testing.T) {
+	for _, n := range []int{2, 10000} {
+		b := NewBitmap(nbits)
+		for i := 0; i < n; i++ {
+			b.Add(uint32(i * 3))
+		}
+		// Both orders, the forms must not overwrite each other.
+		marshaled, _ := b.Marshal()
+		raw := b.Bytes()
+		marshaled2, _ := b.Marshal()
+		for i, buf := range [][]byte{marshaled, raw, marshaled2} {
+			b1, err := NewBitmapFromBuf(buf, nbits, true)
+			if err != nil {
+				t.Errorf("%d, %d: Error unmarshalling: %v", n, i, err)
+				continue
+			}
+			if !b1.Equals(b) {
+				t.Errorf("%d, %d: unexpected value", n, i)
+			}
+		}
+	}
+}
+
 func TestMarshalUnmarshalEmpty(t *testing.T) {
 	b := NewBitmap(nbits)
 	if !b.IsEmpty() {
@@ -358,3 +777,1063 @@ func TestMarshalUnmarshalBig(t *testing.T) {
 		t.Error("bitmaps should be equal")
 	}
 }
+
+func TestMarshalPortable(t *testing.T) {
+	b := NewBitmap(nbits)
+	for _, v := range []uint32{1, 3, 12345} {
+		b.Add(v)
+	}
+	buf, err := b.Marshal()
+	if err != nil {
+		t.Error("Error marshalling: ", err)
+		return
+	}
+	// The header and data are little-endian whatever the host.
+	expected := []byte{0, 0, formatVersion, encodingArrayLE, 0x0D, 0xF0, 0xD4, 0xFA, 3, 0, 0, 0, 0x30, 0x75, 0, 0, 1, 0, 3, 0, 0x39, 0x30}
+	if !reflect.DeepEqual(buf, expected) {
+		t.Error("Unexpected value: ", buf)
+		return
+	}
+
+	// Version 1 has a shorter header.
+	buf = make([]byte, headerSize+4)
+	binary.LittleEndian.PutUint64(buf, uint64(bitmapMagic)<<32|uint64(encodingArrayLE)<<24|1<<16|2)
+	binary.LittleEndian.PutUint16(buf[headerSize:], 7)
+	binary.LittleEndian.PutUint16(buf[headerSize+2:], 4000)
+	b1, err := NewBitmapFromBuf(buf, nbits, true)
+	if err != nil {
+		t.Error("Error unmarshalling: ", err)
+		return
+	}
+	if !reflect.DeepEqual(b1.ToArray(), []uint32{7, 4000}) {
+		t.Error("Unexpected value: ", b1.ToArray())
+	}
+
+	binary.LittleEndian.PutUint64(buf, uint64(bitmapMagic)<<32|uint64(encodingArrayLE)<<24|uint64(formatVersion+1)<<16|2)
+	if _, err := NewBitmapFromBuf(buf, nbits, true); err == nil {
+		t.Error("unknown versions should be rejected")
+	}
+}
+
+func TestMarshalPortableBig(t *testing.T) {
+	b := NewBitmap(nbits)
+	for v := uint32(0); v < uint32(nbits); v += 3 {
+		b.Add(v)
+	}
+	buf, err := b.Marshal()
+	if err != nil {
+		t.Error("Error marshalling: ", err)
+		return
+	}
+	if buf[3] != encodingBitmapLE {
+		t.Error("Unexpected encoding: ", buf[3])
+		return
+	}
+	if binary.LittleEndian.Uint64(buf[extHeaderSize:]) != 0x9249249249249249 {
+		t.Errorf("Unexpected data: %x", buf[extHeaderSize:extHeaderSize+8])
+		return
+	}
+	b1, err := NewBitmapFromBuf(buf, nbits, true)
+	if err != nil {
+		t.Error("Error unmarshalling: ", err)
+		return
+	}
+	if !b1.Equals(b) {
+		t.Error("bitmaps should be equal")
+	}
+}
+
+func TestUnmarshalLegacy(t *testing.T) {
+	b := NewBitmap(nbits)
+	for v := uint32(0); v < uint32(nbits); v += 2 {
+		b.Add(v)
+	}
+	// Bytes still produces the native legacy form.
+	buf := b.Bytes()
+	var h header
+	h.read(buf)
+	if h.encoding != encodingBitmap {
+		t.Error("Unexpected encoding: ", h.encoding)
+		return
+	}
+	b1, err := NewBitmapFromBuf(buf, nbits, true)
+	if err != nil {
+		t.Error("Error unmarshalling: ", err)
+		return
+	}
+	if !b1.Equals(b) {
+		t.Error("bitmaps should be equal")
+	}
+}
+
+func TestMarshalLargeCardinality(t *testing.T) {
+	n := 1 << 18
+	b := NewBitmap(n)
+	for v := uint32(0); v < 140000; v += 2 {
+		b.Add(v)
+	}
+	buf, err := b.Marshal()
+	if err != nil {
+		t.Error("Error marshalling: ", err)
+		return
+	}
+	b1, err := NewBitmapFromBuf(buf, n, true)
+	if err != nil {
+		t.Error("Error unmarshalling: ", err)
+		return
+	}
+	if b1.GetCardinality() != 70000 || !b1.Equals(b) {
+		t.Error("Unexpected cardinality: ", b1.GetCardinality())
+		return
+	}
+
+	// The legacy header truncates the cardinality, it is recomputed.
+	b1, err = NewBitmapFromBuf(b.Bytes(), n, true)
+	if err != nil {
+		t.Error("Error unmarshalling: ", err)
+		return
+	}
+	if b1.GetCardinality() != 70000 || !b1.Equals(b) {
+		t.Error("Unexpected cardinality: ", b1.GetCardinality())
+		return
+	}
+
+	if _, err := NewBitmapFromBuf(buf, n+1, true); err == nil {
+		t.Error("a different number of bits should be rejected")
+	}
+}
+
+func TestMarshalWide(t *testing.T) {
+	n := 1 << 20
+	b := NewBitmap(n)
+	values := []uint32{0, 1, 65535, 65536, 70000, 500000, uint32(n - 1)}
+	for _, v := range values {
+		b.Add(v)
+	}
+	buf, err := b.Marshal()
+	if err != nil {
+		t.Error("Error marshalling: ", err)
+		return
+	}
+	if buf[3] != encodingArray32LE || len(buf) != extHeaderSize+len(values)*4 {
+		t.Error("Unexpected encoding: ", buf[3], len(buf))
+		return
+	}
+	b1, err := NewBitmapFromBuf(buf, n, true)
+	if err != nil {
+		t.Error("Error unmarshalling: ", err)
+		return
+	}
+	if !reflect.DeepEqual(b1.ToArray(), values) {
+		t.Error("Unexpected value: ", b1.ToArray())
+		return
+	}
+
+	if _, err := NewBitmapFromBuf(buf, 500000, true); err == nil {
+		t.Error("values out of range should be rejected")
+	}
+}
+
+func TestRoaringFormat(t *testing.T) {
+	b := NewBitmap(nbits)
+	for v := uint32(0); v < 10000; v++ {
+		b.Add(v)
+	}
+	if b.encoding != encodingRun {
+		t.Error("Unexpected encoding: ", b.encoding)
+		return
+	}
+	buf, err := b.MarshalRoaring()
+	if err != nil {
+		t.Error("Error marshalling: ", err)
+		return
+	}
+	// Cookie and containers-1, run flags, key and cardinality-1, runs.
+	expected := []byte{0x3B, 0x30, 0, 0, 1, 0, 0, 0x0F, 0x27, 1, 0, 0, 0, 0x0F, 0x27}
+	if !reflect.DeepEqual(buf, expected) {
+		t.Error("Unexpected value: ", buf)
+		return
+	}
+
+	small := NewBitmap(nbits)
+	for _, v := range []uint32{20000, 20002, 29999} {
+		b.Add(v)
+		small.Add(v)
+	}
+	b1 := b.Clone()
+	b1.convertEncoding(encodingBitmap)
+	for _, b := range []*Bitmap{b, b1, small} {
+		buf, err := b.MarshalRoaring()
+		if err != nil {
+			t.Error("Error marshalling: ", err)
+			return
+		}
+		b2, err := NewBitmapFromRoaring(buf, nbits)
+		if err != nil {
+			t.Error("Error unmarshalling: ", err)
+			return
+		}
+		if !b2.Equals(b) {
+			t.Errorf("bitmaps should be equal for encoding %x", b.encoding)
+			return
+		}
+	}
+
+	if _, err := NewBitmapFromRoaring(buf, 5000); err == nil {
+		t.Error("values out of range should be rejected")
+	}
+	buf[0] = 0
+	if _, err := NewBitmapFromRoaring(buf, nbits); err == nil {
+		t.Error("bad cookies should be rejected")
+	}
+}
+
+func TestIterator(t *testing.T) {
+	b := NewBitmap(nbits)
+	it := b.Iterator()
+	if it.HasNext() {
+		t.Error("empty bitmaps should have no integers")
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 40; i++ {
+		b.Add(uint32(r.Intn(nbits)))
+	}
+	b.Add(0)
+	b.Add(uint32(nbits - 1))
+	b.FlipInt(5000, 15000)
+	arr := b.ToArray()
+
+	small := NewBitmap(nbits)
+	for _, v := range arr[:100] {
+		small.Add(v)
+	}
+	b1 := b.Clone()
+	b1.convertEncoding(encodingBitmap)
+	if b.encoding != encodingRun || small.encoding != encodingArray {
+		t.Error("Unexpected encodings: ", b.encoding, small.encoding)
+		return
+	}
+	for _, b := range []*Bitmap{b, b1, small} {
+		testIterator(t, r, b)
+	}
+}
+
+func testIterator(t *testing.T, r *rand.Rand, b *Bitmap) {
+	arr := b.ToArray()
+
+	var values []uint32
+	for it := b.Iterator(); it.HasNext(); {
+		v := it.PeekNext()
+		if it.Next() != v {
+			t.Error("PeekNext should return the next integer")
+		}
+		values = append(values, v)
+	}
+	if !reflect.DeepEqual(values, arr) {
+		t.Error("Unexpected value: ", values)
+		return
+	}
+
+	for i := 0; i < 100; i++ {
+		it := b.Iterator()
+		min, from := uint32(0), uint32(0)
+		for j := 0; j < 5 && it.HasNext(); j++ {
+			min += uint32(r.Intn(nbits / 4))
+			it.AdvanceIfNeeded(min)
+			if from < min {
+				from = min
+			}
+			k := sort.Search(len(arr), func(k int) bool { return arr[k] >= from })
+			if k == len(arr) {
+				if it.HasNext() {
+					t.Errorf("expected no integers after %d, but had %d", min, it.PeekNext())
+				}
+				break
+			}
+			if !it.HasNext() || it.Next() != arr[k] {
+				t.Errorf("expected %d after %d", arr[k], min)
+				return
+			}
+			from = arr[k] + 1
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	b := NewBitmap(nbits)
+	if b.ReverseIterator().HasNext() {
+		t.Error("empty bitmaps should have no integers")
+	}
+	if values, more := b.PrevMany(uint32(nbits), nil, 10); len(values) != 0 || more {
+		t.Error("Unexpected value: ", values)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 40; i++ {
+		b.Add(uint32(r.Intn(nbits)))
+	}
+	b.Add(0)
+	b.Add(uint32(nbits - 1))
+	b.FlipInt(5000, 15000)
+
+	small := NewBitmap(nbits)
+	for _, v := range b.ToArray()[:100] {
+		small.Add(v)
+	}
+	b1 := b.Clone()
+	b1.convertEncoding(encodingBitmap)
+	if b.encoding != encodingRun || small.encoding != encodingArray {
+		t.Error("Unexpected encodings: ", b.encoding, small.encoding)
+		return
+	}
+	for _, b := range []*Bitmap{b, b1, small} {
+		testReverse(t, r, b)
+	}
+}
+
+func testReverse(t *testing.T, r *rand.Rand, b *Bitmap) {
+	arr := b.ToArray()
+	reversed := make([]uint32, len(arr))
+	for i, v := range arr {
+		reversed[len(arr)-1-i] = v
+	}
+
+	var values []uint32
+	for it := b.ReverseIterator(); it.HasNext(); {
+		v := it.PeekNext()
+		if it.Next() != v {
+			t.Error("PeekNext should return the next integer")
+		}
+		values = append(values, v)
+	}
+	if !reflect.DeepEqual(values, reversed) {
+		t.Error("Unexpected value: ", values)
+		return
+	}
+
+	// Page from the top.
+	values = values[:0]
+	buf := make([]uint32, 0, 7)
+	j := uint32(nbits + 1000)
+	for {
+		var more bool
+		buf, more = b.PrevMany(j, buf[:0], 7)
+		values = append(values, buf...)
+		if !more || buf[len(buf)-1] == 0 {
+			break
+		}
+		j = buf[len(buf)-1] - 1
+	}
+	if !reflect.DeepEqual(values, reversed) {
+		t.Error("Unexpected value: ", values)
+		return
+	}
+
+	for i := 0; i < 100; i++ {
+		x := uint32(r.Intn(nbits))
+		k := len(arr) - sort.Search(len(arr), func(k int) bool { return arr[k] > x })
+		expected := reversed[k:]
+		if len(expected) > 5 {
+			expected = expected[:5]
+		}
+		values, more := b.PrevMany(x, nil, 5)
+		if !reflect.DeepEqual(values, expected) || more != (len(expected) == 5) {
+			t.Errorf("Unexpected values from %d: %v", x, values)
+			return
+		}
+	}
+}
+
+func TestNextMany(t *testing.T) {
+	b := NewBitmap(nbits)
+	if values, more := b.NextMany(0, nil, 10); len(values) != 0 || more {
+		t.Error("Unexpected value: ", values)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 40; i++ {
+		b.Add(uint32(r.Intn(nbits)))
+	}
+	b.Add(0)
+	b.Add(uint32(nbits - 1))
+	b.FlipInt(5000, 15000)
+
+	small := NewBitmap(nbits)
+	for _, v := range b.ToArray()[:100] {
+		small.Add(v)
+	}
+	b1 := b.Clone()
+	b1.convertEncoding(encodingBitmap)
+	for _, b := range []*Bitmap{b, b1, small} {
+		arr := b.ToArray()
+
+		var values []uint32
+		buf := make([]uint32, 0, 7)
+		j := uint32(0)
+		for {
+			var more bool
+			buf, more = b.NextMany(j, buf[:0], 7)
+			values = append(values, buf...)
+			if !more {
+				break
+			}
+			j = buf[len(buf)-1] + 1
+		}
+		if !reflect.DeepEqual(values, arr) {
+			t.Errorf("Unexpected value for encoding %x: %v", b.encoding, values)
+			return
+		}
+
+		for i := 0; i < 100; i++ {
+			x := uint32(r.Intn(nbits))
+			expected := arr[sort.Search(len(arr), func(k int) bool { return arr[k] >= x }):]
+			if len(expected) > 5 {
+				expected = expected[:5]
+			}
+			values, more := b.NextMany(x, make([]uint32, 0, 5), 5)
+			if !reflect.DeepEqual(values, expected) || more != (len(expected) == 5) {
+				t.Errorf("Unexpected values from %d: %v", x, values)
+				return
+			}
+		}
+		if values, more := b.NextMany(uint32(nbits+1000), nil, 5); len(values) != 0 || more {
+			t.Error("Unexpected value: ", values)
+		}
+	}
+}
+
+func TestAddRemoveRange(t *testing.T) {
+	b := NewBitmap(nbits)
+	b.AddRange(10, 20)
+	b.AddRange(15, 30)
+	if b.encoding != encodingArray || b.GetCardinality() != 20 || !b.Contains(10) || !b.Contains(29) || b.Contains(30) {
+		t.Error("Unexpected value: ", b.ToArray())
+	}
+	b.AddRange(1000, 20000)
+	if b.encoding != encodingRun || b.GetCardinality() != 19020 {
+		t.Errorf("Unexpected encoding %x with cardinality %d", b.encoding, b.GetCardinality())
+	}
+	b.RemoveRange(0, nbits)
+	if !b.IsEmpty() {
+		t.Error("Unexpected value: ", b.ToArray())
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, encoding := range []byte{encodingArray, encodingBitmap, encodingRun} {
+		b := NewBitmap(nbits)
+		expected := make([]bool, nbits)
+		for i := 0; i < 300; i++ {
+			// Use the encoding whenever the content fits in it.
+			switch encoding {
+			case encodingArray:
+				if b.GetCardinality() < uint64(b.array.sz) {
+					b.convertEncoding(encoding)
+				}
+			case encodingBitmap:
+				b.convertEncoding(encoding)
+			case encodingRun:
+				c := b.Clone()
+				c.convertEncoding(encodingBitmap)
+				if c.bitmap.numberOfRuns(b.run.sz) < b.run.sz {
+					b.convertEncoding(encoding)
+				}
+			}
+			start := r.Intn(nbits)
+			stop := start + r.Intn(min(nbits-start, []int{10, 100, 10000}[i%3])+1)
+			add := i%2 == 0
+			if add {
+				b.AddRange(start, stop)
+			} else {
+				b.RemoveRange(start, stop)
+			}
+			for v := start; v < stop; v++ {
+				expected[v] = add
+			}
+
+			arr := []uint32{}
+			for v, ok := range expected {
+				if ok {
+					arr = append(arr, uint32(v))
+				}
+			}
+			if !reflect.DeepEqual(b.ToArray(), arr) {
+				t.Errorf("%x %d: unexpected value after range [%d,%d)", encoding, i, start, stop)
+				return
+			}
+			if b.GetCardinality() != uint64(len(arr)) {
+				t.Errorf("%x %d: expected cardinality %d, but had %d", encoding, i, len(arr), b.GetCardinality())
+				return
+			}
+		}
+	}
+}
+
+func TestRangeQueries(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	b := NewBitmap(nbits)
+	for i := 0; i < 40; i++ {
+		b.Add(uint32(r.Intn(nbits)))
+	}
+	b.AddRange(5000, 15000)
+	b.AddRange(nbits-100, nbits)
+
+	small := NewBitmap(nbits)
+	for _, v := range b.ToArray()[:100] {
+		small.Add(v)
+	}
+	b1 := b.Clone()
+	b1.convertEncoding(encodingBitmap)
+	for _, b := range []*Bitmap{b, b1, small} {
+		arr := b.ToArray()
+
+		for i := 0; i < 500; i++ {
+			start := r.Intn(nbits+20) - 10
+			stop := start + r.Intn([]int{3, 100, 10000}[i%3])
+			if i%4 == 0 {
+				start &^= 63
+				stop &^= 63
+			}
+			expected := []uint32{}
+			for _, v := range arr {
+				if int(v) >= start && int(v) < stop {
+					expected = append(expected, v)
+				}
+			}
+			all := start >= stop || start >= 0 && stop <= nbits && len(expected) == stop-start
+			if values := b.ToArrayInRange(start, stop); !reflect.DeepEqual(values, expected) {
+				t.Errorf("%x [%d,%d): unexpected value %v", b.encoding, start, stop, values)
+				return
+			}
+			if b.CardinalityInRange(start, stop) != uint64(len(expected)) {
+				t.Errorf("%x [%d,%d): unexpected cardinality %d", b.encoding, start, stop, b.CardinalityInRange(start, stop))
+				return
+			}
+			if b.ContainsAnyInRange(start, stop) != (len(expected) > 0) {
+				t.Errorf("%x [%d,%d): unexpected ContainsAnyInRange", b.encoding, start, stop)
+				return
+			}
+			if b.ContainsAllInRange(start, stop) != all {
+				t.Errorf("%x [%d,%d): unexpected ContainsAllInRange", b.encoding, start, stop)
+				return
+			}
+		}
+	}
+}
+
+func TestMinimumMaximum(t *testing.T) {
+	b := NewBitmap(nbits)
+	if _, ok := b.Minimum(); ok {
+		t.Error("empty bitmap should have no minimum")
+	}
+	if _, ok := b.Maximum(); ok {
+		t.Error("empty bitmap should have no maximum")
+	}
+	b.Add(129)
+	b.Add(20000)
+	b.AddRange(63, 65)
+	run := b.Clone()
+	run.AddRange(1000, 10000)
+	b1 := b.Clone()
+	b1.convertEncoding(encodingBitmap)
+	for _, b := range []*Bitmap{b, b1, run} {
+		if v, ok := b.Minimum(); v != 63 || !ok {
+			t.Errorf("Unexpected minimum for encoding %x: %d", b.encoding, v)
+		}
+		if v, ok := b.Maximum(); v != 20000 || !ok {
+			t.Errorf("Unexpected maximum for encoding %x: %d", b.encoding, v)
+		}
+	}
+	if run.encoding != encodingRun {
+		t.Errorf("Unexpected encoding %x", run.encoding)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	b := NewBitmap(nbits)
+	if err := b.TryAdd(1<<16 + 5); err != ErrOutOfRange {
+		t.Error("Unexpected error: ", err)
+	}
+	if err := b.TryRemove(uint32(nbits)); err != ErrOutOfRange {
+		t.Error("Unexpected error: ", err)
+	}
+	if b.Contains(5) {
+		t.Error("out of range values should not wrap around")
+	}
+	if err := b.TryAdd(uint32(nbits - 1)); err != nil || !b.Contains(uint32(nbits-1)) {
+		t.Error("Unexpected error: ", err)
+	}
+
+	b = NewBitmap(nbits, Strict())
+	b.Add(5)
+	b.AddRange(1000, 20000)
+	b1 := b.Clone()
+	b1.convertEncoding(encodingBitmap)
+	for _, b := range []*Bitmap{b, b1} {
+		card := b.GetCardinality()
+		for _, v := range []uint32{uint32(nbits), 1<<16 + 5, 1 << 31} {
+			b.Add(v)
+			b.Remove(v)
+			if b.Contains(v) {
+				t.Errorf("%d should be ignored", v)
+			}
+		}
+		if b.GetCardinality() != card || !b.Contains(5) {
+			t.Errorf("Unexpected value for encoding %x", b.encoding)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	b := NewBitmap(nbits)
+	for _, v := range []uint32{1, 5, 9} {
+		b.Add(v)
+	}
+	marshal := func(b *Bitmap) []byte {
+		buf, _ := b.Marshal()
+		return buf
+	}
+	array := marshal(b)
+	b.AddRange(100, 200)
+	b.AddRange(300, 400)
+	run := marshal(b)
+	for i := 0; i < 1000; i++ {
+		b.Add(uint32(i * 3))
+	}
+	bitmap := marshal(b)
+
+	large := NewBitmap(nbits)
+	for i := 0; i < large.array.sz; i++ {
+		large.Add(uint32(i * 3))
+	}
+	large.convertEncoding(encodingArray)
+	largeArray := marshal(large)
+
+	for i, buf := range [][]byte{array, run, bitmap} {
+		if buf[3] != []byte{encodingArrayLE, encodingRunLE, encodingBitmapLE}[i] {
+			t.Errorf("Unexpected encoding %x", buf[3])
+		}
+		if _, err := NewBitmapFromBuf(buf, nbits, true, Validate()); err != nil {
+			t.Error("Error unmarshalling: ", err)
+		}
+	}
+
+	corrupt := func(buf []byte, f func(buf []byte)) []byte {
+		buf = append([]byte(nil), buf...)
+		f(buf)
+		return buf
+	}
+	for i, c := range []struct {
+		buf []byte
+		err error
+	}{
+		{corrupt(array, func(buf []byte) { binary.LittleEndian.PutUint16(buf[extHeaderSize+2:], 1) }), ErrUnsorted},
+		{corrupt(array, func(buf []byte) { binary.LittleEndian.PutUint16(buf[extHeaderSize+4:], uint16(nbits)) }), ErrOutOfRange},
+		{largeArray, ErrTooLarge},
+		// Runs overlapping, touching and past nbits.
+		{corrupt(run, func(buf []byte) { binary.LittleEndian.PutUint16(buf[extHeaderSize+8:], 150) }), ErrUnsorted},
+		{corrupt(run, func(buf []byte) { binary.LittleEndian.PutUint16(buf[extHeaderSize+8:], 200) }), ErrUnsorted},
+		{corrupt(run, func(buf []byte) { binary.LittleEndian.PutUint16(buf[extHeaderSize+10:], uint16(nbits)) }), ErrOutOfRange},
+		{corrupt(bitmap, func(buf []byte) { binary.LittleEndian.PutUint32(buf[8:], 5) }), ErrCardinality},
+		{corrupt(bitmap, func(buf []byte) { buf[extHeaderSize+nbits/8] |= 1 }), ErrOutOfRange},
+	} {
+		if _, err := NewBitmapFromBuf(c.buf, nbits, true); err != nil {
+			t.Errorf("%d: the data should be trusted without validation: %v", i, err)
+		}
+		if _, err := NewBitmapFromBuf(c.buf, nbits, true, Validate()); !errors.Is(err, c.err) {
+			t.Errorf("%d: expected %v, but had %v", i, c.err, err)
+		}
+	}
+
+	// Arrays and runs larger than the buffer are always rejected.
+	buf := make([]byte, extHeaderSize+2*bodySize(nbits))
+	copy(buf, array[:extHeaderSize])
+	binary.LittleEndian.PutUint32(buf[8:], uint32(bodySize(nbits)))
+	if _, err := NewBitmapFromBuf(buf, nbits, true); !errors.Is(err, ErrTooLarge) {
+		t.Error("Unexpected error: ", err)
+	}
+	buf = append(buf, make([]byte, 2*bodySize(nbits))...)
+	buf[3] = encodingRunLE
+	if _, err := NewBitmapFromBuf(buf, nbits, true); !errors.Is(err, ErrTooLarge) {
+		t.Error("Unexpected error: ", err)
+	}
+
+	// The content must fill the data exactly, and legacy headers hold the
+	// cardinality of bitmaps modulo 65536.
+	if _, err := NewBitmapFromBuf(append(array, 0, 0), nbits, true, Validate()); !errors.Is(err, ErrSize) {
+		t.Error("Unexpected error: ", err)
+	}
+	legacy := append([]byte(nil), b.Bytes()...)
+	if _, err := NewBitmapFromBuf(legacy, nbits, true, Validate()); err != nil {
+		t.Error("Error unmarshalling: ", err)
+	}
+	var h header
+	h.read(legacy)
+	h.cardinality++
+	h.write(legacy)
+	if _, err := NewBitmapFromBuf(legacy, nbits, true, Validate()); !errors.Is(err, ErrCardinality) {
+		t.Error("Unexpected error: ", err)
+	}
+	wide := NewBitmap(100000)
+	wide.AddRange(0, 99999)
+	if _, err := NewBitmapFromBuf(wide.Bytes(), 100000, true, Validate()); err != nil {
+		t.Error("Error unmarshalling: ", err)
+	}
+}
+
+func TestMarshalChecksum(t *testing.T) {
+	array := NewBitmap(nbits)
+	array.Add(5)
+	array.Add(4000)
+	run := NewBitmap(nbits)
+	run.AddRange(1000, 5000)
+	bitmap := run.Clone()
+	bitmap.convertEncoding(encodingBitmap)
+	bitmaps := []*Bitmap{array, run, bitmap}
+
+	for _, b := range bitmaps {
+		buf, err := b.MarshalChecksum()
+		if err != nil {
+			t.Error("Error marshalling: ", err)
+			return
+		}
+		if buf[0]&1 == 0 {
+			t.Error("the checksum flag should be set")
+		}
+		b1, err := NewBitmapFromBuf(buf, nbits, false)
+		if err != nil {
+			t.Error("Error unmarshalling: ", err)
+			return
+		}
+		if !b1.Equals(b) {
+			t.Error("Unexpected value: ", b1.ToArray())
+		}
+		for _, i := range []int{9, extHeaderSize, len(buf) - 5, len(buf) - 1} {
+			corrupt := append([]byte(nil), buf...)
+			corrupt[i] ^= 0x10
+			if _, err := NewBitmapFromBuf(corrupt, nbits, true); !errors.Is(err, ErrChecksum) {
+				t.Errorf("%d: Unexpected error: %v", i, err)
+			}
+		}
+		unknown := append([]byte(nil), buf...)
+		unknown[0] |= 0x80
+		if _, err := NewBitmapFromBuf(unknown, nbits, true); err == nil {
+			t.Error("unknown flags should be rejected")
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	b := NewBitmap(nbits)
+	b.AddRange(0, 5000)
+	b.convertEncoding(encodingBitmap)
+	buf, _ := b.Marshal()
+
+	set := func(f func(buf []byte)) []byte {
+		buf := append([]byte(nil), buf...)
+		f(buf)
+		return buf
+	}
+	for i, c := range []struct {
+		buf      []byte
+		nbits    int
+		err      error
+		expected *DecodeError
+	}{
+		{buf[:5], nbits, ErrInvalidData, &DecodeError{Offset: 5, Expected: 8, Actual: 5}},
+		{set(func(buf []byte) { buf[4] = 0 }), nbits, ErrBadMagic, &DecodeError{Offset: 4}},
+		{set(func(buf []byte) { buf[2] = 9 }), nbits, ErrUnsupportedVersion, &DecodeError{Encoding: encodingBitmapLE, Offset: 2}},
+		{set(func(buf []byte) { buf[1] = 1 }), nbits, ErrUnsupportedFlags, &DecodeError{Encoding: encodingBitmapLE}},
+		{set(func(buf []byte) { buf[3] = 0x55 }), nbits, ErrBadEncoding, &DecodeError{Encoding: 0x55, Offset: 3}},
+		{buf[:len(buf)-1], nbits, ErrSize, &DecodeError{Encoding: encodingBitmapLE, Offset: len(buf) - 1, Expected: len(buf), Actual: len(buf) - 1}},
+		{buf, nbits + 1, ErrNbits, &DecodeError{Encoding: encodingBitmapLE, Offset: 12, Expected: nbits + 1, Actual: nbits}},
+	} {
+		_, err := NewBitmapFromBuf(c.buf, c.nbits, true)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%d: expected %v, but had %v", i, c.err, err)
+			continue
+		}
+		var e *DecodeError
+		if !errors.As(err, &e) {
+			t.Errorf("%d: expected a DecodeError, but had %T", i, err)
+			continue
+		}
+		c.expected.Err = c.err
+		if *e != *c.expected {
+			t.Errorf("%d: expected %+v, but had %+v", i, c.expected, e)
+		}
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	array := NewBitmap(nbits)
+	array.Add(5)
+	array.Add(4000)
+	bitmap := NewBitmap(nbits)
+	bitmap.AddRange(1000, 5000)
+	bitmap.Add(20000)
+	run := bitmap.Clone()
+	run.AddRange(0, 10000)
+	bitmap.convertEncoding(encodingBitmap)
+
+	var stream bytes.Buffer
+	for _, b := range []*Bitmap{array, bitmap, run} {
+		if _, err := b.WriteTo(&stream); err != nil {
+			t.Error("Error writing: ", err)
+			return
+		}
+	}
+	checksum, _ := bitmap.MarshalChecksum()
+	stream.Write(checksum)
+	stream.Write(bitmap.Bytes())
+	data := stream.Bytes()
+
+	r := iotest.OneByteReader(bytes.NewReader(data))
+	read := int64(0)
+	for _, expected := range append([]*Bitmap{array, bitmap, run}, bitmap, bitmap) {
+		b := NewBitmap(nbits)
+		n, err := b.ReadFrom(r)
+		if err != nil {
+			t.Error("Error reading: ", err)
+			return
+		}
+		read += n
+		if !b.Equals(expected) {
+			t.Error("Unexpected value: ", b.ToArray())
+		}
+	}
+	if read != int64(len(data)) {
+		t.Errorf("expected %d bytes read, but had %d", len(data), read)
+	}
+	if _, err := NewBitmap(nbits).ReadFrom(r); err != io.EOF {
+		t.Error("Unexpected error: ", err)
+	}
+	for _, l := range []int{3, 12, 18} {
+		if _, err := NewBitmap(nbits).ReadFrom(bytes.NewReader(data[:l])); err != io.ErrUnexpectedEOF {
+			t.Errorf("%d: Unexpected error: %v", l, err)
+		}
+	}
+}
+
+func TestWriteToMatchesMarshal(t *testing.T) {
+	defer func(le bool, size int) {
+		littleEndian = le
+		writeChunkSize = size
+	}(littleEndian, writeChunkSize)
+
+	for _, n := range []int{nbits, 100000} {
+		for _, card := range []int{0, 10, 10000} {
+			b := NewBitmap(n)
+			for i := 0; i < card; i++ {
+				b.Add(uint32(i * 3 % n))
+			}
+			expected, _ := b.Marshal()
+			var buf bytes.Buffer
+			written, err := b.WriteTo(&buf)
+			if err != nil || written != int64(buf.Len()) || !bytes.Equal(buf.Bytes(), expected) {
+				t.Errorf("%d, %d: unexpected form, %d bytes written: %v", n, card, written, err)
+			}
+
+			// The chunks of big-endian hosts, whose conversion is the
+			// identity here.
+			littleEndian = false
+			writeChunkSize = 24
+			buf.Reset()
+			written, err = writeLE(&buf, expected[extHeaderSize:], expected[3])
+			if err != nil || written != int64(buf.Len()) || !bytes.Equal(buf.Bytes(), expected[extHeaderSize:]) {
+				t.Errorf("%d, %d: unexpected chunks, %d bytes written: %v", n, card, written, err)
+			}
+			littleEndian = true
+		}
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	type config struct {
+		Name string
+		IDs  Bitmap
+	}
+	for _, r := range [][2]int{{0, 0}, {5, 7}, {1000, 25000}} {
+		in := config{Name: "test"}
+		in.IDs = *NewBitmap(nbits)
+		in.IDs.AddRange(r[0], r[1])
+		in.IDs.Add(29999)
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&in); err != nil {
+			t.Error("Error encoding: ", err)
+			return
+		}
+		var out config
+		if err := gob.NewDecoder(&buf).Decode(&out); err != nil {
+			t.Error("Error decoding: ", err)
+			return
+		}
+		if out.Name != in.Name || out.IDs.nbits != nbits || !out.IDs.Equals(&in.IDs) {
+			t.Error("Unexpected value: ", out.IDs.ToArray())
+		}
+
+		text, err := in.IDs.MarshalText()
+		if err != nil {
+			t.Error("Error marshalling: ", err)
+			return
+		}
+		var b Bitmap
+		if err := b.UnmarshalText(text); err != nil || !b.Equals(&in.IDs) {
+			t.Error("Unexpected value: ", b.ToArray(), err)
+		}
+	}
+
+	data, _ := NewBitmap(nbits).MarshalBinary()
+	if err := NewBitmap(nbits / 2).UnmarshalBinary(data); !errors.Is(err, ErrNbits) {
+		t.Error("Unexpected error: ", err)
+	}
+
+	// The older headers don't carry nbits, the bitmap must have them.
+	legacy := NewBitmap(nbits)
+	legacy.Add(5)
+	legacy.Add(4000)
+	if err := new(Bitmap).UnmarshalBinary(legacy.Bytes()); !errors.Is(err, ErrNbits) {
+		t.Error("Unexpected error: ", err)
+	}
+	b := NewBitmap(nbits)
+	if err := b.UnmarshalBinary(legacy.Bytes()); err != nil || !b.Equals(legacy) {
+		t.Error("Unexpected value: ", b.ToArray(), err)
+	}
+	v1, _ := legacy.Marshal()
+	var h header
+	h.read(v1)
+	h.readExt(v1)
+	h.version = 1
+	binary.LittleEndian.PutUint64(v1[extHeaderSize-headerSize:], h.value())
+	v1 = v1[extHeaderSize-headerSize:]
+	b = NewBitmap(nbits)
+	if err := b.UnmarshalBinary(v1); err != nil || !b.Equals(legacy) {
+		t.Error("Unexpected value: ", b.ToArray(), err)
+	}
+
+	// The header of a small array can't ask for a huge bitmap.
+	binary.LittleEndian.PutUint32(data[12:], 1<<32-1)
+	if err := new(Bitmap).UnmarshalBinary(data); !errors.Is(err, ErrNbits) {
+		t.Error("Unexpected error: ", err)
+	}
+	text, _ := json.Marshal(data)
+	if err := json.Unmarshal(text, new(Bitmap)); !errors.Is(err, ErrNbits) {
+		t.Error("Unexpected error: ", err)
+	}
+	big := NewBitmap(MaxUnmarshalNbits + 64)
+	big.AddRange(0, MaxUnmarshalNbits+64)
+	data, _ = big.MarshalBinary()
+	if err := new(Bitmap).UnmarshalBinary(data); err != nil {
+		t.Error("Error unmarshalling: ", err)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	type config struct {
+		IDs Bitmap `json:"ids"`
+	}
+	in := config{IDs: *NewBitmap(nbits)}
+	in.IDs.Add(5)
+	in.IDs.Add(4000)
+	data, err := json.Marshal(&in)
+	if err != nil {
+		t.Error("Error marshalling: ", err)
+		return
+	}
+	if value, _ := json.Marshal(in); !bytes.Equal(value, data) {
+		t.Error("Unexpected JSON: ", string(value))
+	}
+	var out config
+	if err := json.Unmarshal(data, &out); err != nil || !out.IDs.Equals(&in.IDs) {
+		t.Error("Unexpected value: ", out.IDs.ToArray(), err)
+	}
+
+	in.IDs = *NewBitmap(nbits, JSONArray())
+	in.IDs.Add(4000)
+	in.IDs.Add(5)
+	data, err = json.Marshal(&in)
+	if err != nil {
+		t.Error("Error marshalling: ", err)
+		return
+	}
+	if string(data) != `{"ids":[5,4000]}` {
+		t.Error("Unexpected JSON: ", string(data))
+	}
+	out = config{IDs: *NewBitmap(nbits, JSONArray())}
+	if err := json.Unmarshal(data, &out); err != nil || !out.IDs.Equals(&in.IDs) {
+		t.Error("Unexpected value: ", out.IDs.ToArray(), err)
+	}
+	data, _ = json.Marshal(&out)
+	if string(data) != `{"ids":[5,4000]}` {
+		t.Error("Unexpected JSON: ", string(data))
+	}
+
+	if err := json.Unmarshal([]byte(`{"ids":[5,30000]}`), &out); !errors.Is(err, ErrOutOfRange) {
+		t.Error("Unexpected error: ", err)
+	}
+	if err := json.Unmarshal([]byte(`{"ids":null}`), &out); err != nil || !out.IDs.Equals(&in.IDs) {
+		t.Error("Unexpected value: ", out.IDs.ToArray(), err)
+	}
+}
+
+func TestWideArrayBlob(t *testing.T) {
+	nbits := 100000
+	for _, h := range []header{
+		{magic: bitmapMagic, encoding: encodingArray, cardinality: 2},
+		{magic: bitmapMagic, encoding: encodingArrayLE, version: formatVersion, cardinality: 2, nbits: uint32(nbits)},
+	} {
+		buf := make([]byte, extHeaderSize+4)
+		if h.version == formatVersion {
+			h.writeLE(buf)
+			binary.LittleEndian.PutUint16(buf[extHeaderSize:], 5)
+			binary.LittleEndian.PutUint16(buf[extHeaderSize+2:], 60000)
+		} else {
+			// The legacy encodings are in the byte order of the host.
+			buf = buf[:headerSize+4]
+			h.write(buf)
+			copy(toUint16Slice(buf[headerSize:], 2), []uint16{5, 60000})
+		}
+
+		b, err := NewBitmapFromBuf(buf, nbits, true)
+		if err != nil {
+			t.Error("Error unmarshalling: ", err)
+			return
+		}
+		if b.encoding != encodingBitmap {
+			t.Errorf("expected the bitmap encoding, but had %x", b.encoding)
+		}
+		b.Add(70000)
+		data, _ := b.Marshal()
+		b1, err := NewBitmapFromBuf(data, nbits, true)
+		if err != nil {
+			t.Error("Error unmarshalling: ", err)
+			return
+		}
+		if !reflect.DeepEqual(b1.ToArray(), []uint32{5, 60000, 70000}) {
+			t.Error("Unexpected value: ", b1.ToArray())
+		}
+	}
+}
+
+func TestValidateSmallNbits(t *testing.T) {
+	for _, nbits := range []int{1, 64, 127, 128, 200, 383, 384, 1000} {
+		b := NewBitmap(nbits)
+		check := func(step string) {
+			buf, _ := b.Marshal()
+			b1, err := NewBitmapFromBuf(buf, nbits, true, Validate())
+			if err != nil {
+				t.Errorf("%d, %s: Error unmarshalling: %v", nbits, step, err)
+				return
+			}
+			if !b1.Equals(b) {
+				t.Errorf("%d, %s: unexpected value", nbits, step)
+			}
+		}
+		check("empty")
+		b.Add(0)
+		b.Add(uint32(nbits - 1))
+		check("add")
+		b.AddRange(0, nbits/2)
+		check("range")
+		b.RemoveRange(0, nbits)
+		check("remove")
+	}
+}
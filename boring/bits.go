@@ -76,23 +76,245 @@ func (b *bitmap) andNot(o bitmap) {
 	b.cardinality = int(cnt)
 }
 
+func (b *bitmap) andArray(o array) []uint16 {
+	content := make([]uint16, len(o.content))
+	pos := 0
+	for _, v := range o.content {
+		content[pos] = v
+		pos += b.bitValue(uint32(v))
+	}
+	return content[:pos]
+}
+
+func (b *bitmap) andCardinality(o bitmap) int {
+	l := min(len(b.set), len(o.set))
+	cnt := 0
+	for i := 0; i < l; i++ {
+		cnt += bits.OnesCount64(b.set[i] & o.set[i])
+	}
+	return cnt
+}
+
+func (b *bitmap) intersects(o bitmap) bool {
+	l := min(len(b.set), len(o.set))
+	for i := 0; i < l; i++ {
+		if b.set[i]&o.set[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *bitmap) andNotArray(o array) {
 	for _, e := range o.content {
 		b.remove(uint32(e))
 	}
 }
 
+func (b *bitmap) xor(o bitmap) {
+	l := len(o.set)
+	cnt := 0
+	for i := 0; i < l; i++ {
+		v := b.set[i] ^ o.set[i]
+		cnt += bits.OnesCount64(v)
+		b.set[i] = v
+	}
+	b.cardinality = int(cnt)
+}
+
+func (b *bitmap) xorArray(o array) {
+	for _, e := range o.content {
+		v := uint32(e)
+		if b.contains(v) {
+			b.remove(v)
+		} else {
+			b.add(v)
+		}
+	}
+}
+
 func (b *bitmap) flip(start, stop int) {
-	startWord := start >> log2WordSize
-	endWord := stop >> log2WordSize
-	b.set[startWord] ^= ^(^uint64(0) << (start & (wordSize - 1)))
-	for i := startWord; i < endWord; i++ {
-		b.set[i] = ^b.set[i]
+	b.flipRange(start, stop)
+	b.cardinality = int(b.computeCardinality())
+}
+
+func (b *bitmap) orRun(o run) {
+	for i := 0; i < o.numRuns(); i++ {
+		b.setRange(o.start(i), o.last(i)+1)
+	}
+	b.cardinality = int(b.computeCardinality())
+}
+
+func (b *bitmap) andRun(o run) {
+	prev := 0
+	for i := 0; i < o.numRuns(); i++ {
+		b.clearRange(prev, o.start(i))
+		prev = o.last(i) + 1
 	}
-	b.set[endWord] ^= ^uint64(0) >> (-stop & (wordSize - 1))
+	b.clearRange(prev, len(b.set)*wordSize)
 	b.cardinality = int(b.computeCardinality())
 }
 
+func (b *bitmap) andNotRun(o run) {
+	for i := 0; i < o.numRuns(); i++ {
+		b.clearRange(o.start(i), o.last(i)+1)
+	}
+	b.cardinality = int(b.computeCardinality())
+}
+
+func (b *bitmap) xorRun(o run) {
+	for i := 0; i < o.numRuns(); i++ {
+		b.flipRange(o.start(i), o.last(i)+1)
+	}
+	b.cardinality = int(b.computeCardinality())
+}
+
+// The range functions work on [start,stop) and leave the cardinality to the caller.
+
+func (b *bitmap) setRange(start, stop int) {
+	b.applyRange(start, stop, func(w, mask uint64) uint64 { return w | mask })
+}
+
+func (b *bitmap) clearRange(start, stop int) {
+	b.applyRange(start, stop, func(w, mask uint64) uint64 { return w &^ mask })
+}
+
+func (b *bitmap) flipRange(start, stop int) {
+	b.applyRange(start, stop, func(w, mask uint64) uint64 { return w ^ mask })
+}
+
+func (b *bitmap) applyRange(start, stop int, op func(w, mask uint64) uint64) {
+	if start >= stop {
+		return
+	}
+	startWord := start >> log2WordSize
+	endWord := (stop - 1) >> log2WordSize
+	first := ^uint64(0) << (start & (wordSize - 1))
+	last := ^uint64(0) >> (-stop & (wordSize - 1))
+	if startWord == endWord {
+		b.set[startWord] = op(b.set[startWord], first&last)
+		return
+	}
+	b.set[startWord] = op(b.set[startWord], first)
+	for i := startWord + 1; i < endWord; i++ {
+		b.set[i] = op(b.set[i], ^uint64(0))
+	}
+	b.set[endWord] = op(b.set[endWord], last)
+}
+
+// cardinalityInRange returns the number of bits set in [start,stop).
+func (b *bitmap) cardinalityInRange(start, stop int) int {
+	if start >= stop {
+		return 0
+	}
+	startWord := start >> log2WordSize
+	endWord := (stop - 1) >> log2WordSize
+	first := ^uint64(0) << (start & (wordSize - 1))
+	last := ^uint64(0) >> (-stop & (wordSize - 1))
+	if startWord == endWord {
+		return bits.OnesCount64(b.set[startWord] & first & last)
+	}
+	cnt := bits.OnesCount64(b.set[startWord] & first)
+	for _, w := range b.set[startWord+1 : endWord] {
+		cnt += bits.OnesCount64(w)
+	}
+	return cnt + bits.OnesCount64(b.set[endWord]&last)
+}
+
+// containsAnyInRange returns true if a bit is set in [start,stop).
+func (b *bitmap) containsAnyInRange(start, stop int) bool {
+	return !b.testRange(start, stop, func(w, mask uint64) bool { return w&mask == 0 })
+}
+
+// containsAllInRange returns true if all the bits of [start,stop) are set.
+func (b *bitmap) containsAllInRange(start, stop int) bool {
+	return b.testRange(start, stop, func(w, mask uint64) bool { return w&mask == mask })
+}
+
+// testRange returns true if f(word, mask) is true for all the words covering
+// [start,stop), where mask has the bits of the range set.
+func (b *bitmap) testRange(start, stop int, f func(w, mask uint64) bool) bool {
+	if start >= stop {
+		return true
+	}
+	startWord := start >> log2WordSize
+	endWord := (stop - 1) >> log2WordSize
+	first := ^uint64(0) << (start & (wordSize - 1))
+	last := ^uint64(0) >> (-stop & (wordSize - 1))
+	if startWord == endWord {
+		return f(b.set[startWord], first&last)
+	}
+	if !f(b.set[startWord], first) {
+		return false
+	}
+	for _, w := range b.set[startWord+1 : endWord] {
+		if !f(w, ^uint64(0)) {
+			return false
+		}
+	}
+	return f(b.set[endWord], last)
+}
+
+// numberOfRuns returns the number of runs of bits set, it stops
+// counting once limit is reached.
+func (b *bitmap) numberOfRuns(limit int) int {
+	nruns := 0
+	prev := uint64(0)
+	for _, w := range b.set {
+		// A run starts at every bit set whose predecessor isn't.
+		nruns += bits.OnesCount64(w &^ (w<<1 | prev))
+		if nruns >= limit {
+			return nruns
+		}
+		prev = w >> (wordSize - 1)
+	}
+	return nruns
+}
+
+// minimum returns the smallest bit set, the bitmap must not be empty.
+func (b *bitmap) minimum() uint32 {
+	i := 0
+	for b.set[i] == 0 {
+		i++
+	}
+	return uint32(i<<log2WordSize + bits.TrailingZeros64(b.set[i]))
+}
+
+// maximum returns the largest bit set, the bitmap must not be empty.
+func (b *bitmap) maximum() uint32 {
+	i := len(b.set) - 1
+	for b.set[i] == 0 {
+		i--
+	}
+	return uint32(i<<log2WordSize + wordSize - 1 - bits.LeadingZeros64(b.set[i]))
+}
+
+func (b *bitmap) rank(x uint32) int {
+	idx := int(x >> log2WordSize)
+	if idx >= len(b.set) {
+		return b.cardinality
+	}
+	cnt := bits.OnesCount64(b.set[idx] << (wordSize - 1 - (x & (wordSize - 1))))
+	for _, w := range b.set[:idx] {
+		cnt += bits.OnesCount64(w)
+	}
+	return cnt
+}
+
+func (b *bitmap) selectInt(k int) uint32 {
+	for idx, w := range b.set {
+		cnt := bits.OnesCount64(w)
+		if k < cnt {
+			for i := 0; i < k; i++ {
+				w &= w - 1
+			}
+			return uint32(idx)<<log2WordSize + uint32(bits.TrailingZeros64(w))
+		}
+		k -= cnt
+	}
+	return 0
+}
+
 func (b *bitmap) computeCardinality() uint64 {
 	cnt := 0
 	for _, x := range b.set {
@@ -122,45 +344,68 @@ func (b *bitmap) equalsArray(o array) bool {
 }
 
 func (b *bitmap) nextSetMany16(buffer []uint16) {
-	myanswer := buffer
-	capacity := cap(buffer)
-	x := 0
-	if x >= len(b.set) || capacity == 0 {
-		return
+	nextSetMany(b.set, 0, buffer[:0], cap(buffer))
+}
+
+func (b *bitmap) nextSetMany32(buffer []uint32) {
+	nextSetMany(b.set, 0, buffer[:0], cap(buffer))
+}
+
+// nextMany appends the integers larger or equal to i in increasing order, up to limit.
+func (b *bitmap) nextMany(i uint32, buffer []uint32, limit int) ([]uint32, bool) {
+	return nextSetMany(b.set, i, buffer, limit)
+}
+
+// nextSetMany appends the integers of the words larger or equal to i in
+// increasing order, up to limit, and returns true if it stopped at limit.
+func nextSetMany[T uint16 | uint32](set []uint64, i uint32, buffer []T, limit int) ([]T, bool) {
+	x := int(i >> log2WordSize)
+	if x >= len(set) || limit <= 0 {
+		return buffer, false
 	}
-	size := int(0)
-	for idx, word := range b.set {
+	size := 0
+	word := set[x] & (^uint64(0) << (i & (wordSize - 1)))
+	for {
 		for word != 0 {
-			r := bits.TrailingZeros64(word)
-			t := word & ((^word) + 1)
-			myanswer[size] = uint16(r + (x+idx)<<6)
+			buffer = append(buffer, T(x<<log2WordSize+bits.TrailingZeros64(word)))
 			size++
-			if size == capacity {
-				return
+			if size == limit {
+				return buffer, true
 			}
-			word = word ^ t
+			word &= word - 1
+		}
+		x++
+		if x >= len(set) {
+			return buffer, false
 		}
+		word = set[x]
 	}
 }
 
-func (b *bitmap) nextSetMany32(buffer []uint32) {
-	myanswer := buffer
-	capacity := cap(buffer)
-	x := 0
-	if x >= len(b.set) || capacity == 0 {
-		return
+// prevMany appends the integers smaller or equal to i in decreasing order, up to limit.
+func (b *bitmap) prevMany(i uint32, buffer []uint32, limit int) ([]uint32, bool) {
+	x := int(i >> log2WordSize)
+	word := b.set[len(b.set)-1]
+	if x < len(b.set) {
+		word = b.set[x] & (^uint64(0) >> (wordSize - 1 - (i & (wordSize - 1))))
+	} else {
+		x = len(b.set) - 1
 	}
-	size := int(0)
-	for idx, word := range b.set {
+	size := 0
+	for {
 		for word != 0 {
-			r := bits.TrailingZeros64(word)
-			t := word & ((^word) + 1)
-			myanswer[size] = uint32(r + (x+idx)<<6)
+			r := wordSize - 1 - bits.LeadingZeros64(word)
+			buffer = append(buffer, uint32(x<<log2WordSize+r))
 			size++
-			if size == capacity {
-				return
+			if size == limit {
+				return buffer, true
 			}
-			word = word ^ t
+			word &^= 1 << r
+		}
+		x--
+		if x < 0 {
+			return buffer, false
 		}
+		word = b.set[x]
 	}
 }
@@ -0,0 +1,43 @@
+package boring
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+var (
+	// flagChecksum is set in the header of the marshaled forms followed by
+	// a CRC32C of the header and data.
+	flagChecksum = uint16(1)
+	checksumSize = 4
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// MarshalChecksum is Marshal followed by a little-endian CRC32C of the
+// header and data, which NewBitmapFromBuf verifies.
+func (b *Bitmap) MarshalChecksum() ([]byte, error) {
+	data, err := b.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	n := len(data)
+	buf := make([]byte, n+checksumSize)
+	copy(buf, data)
+	binary.LittleEndian.PutUint16(buf, binary.LittleEndian.Uint16(buf)|flagChecksum)
+	binary.LittleEndian.PutUint32(buf[n:], crc32.Checksum(buf[:n], crc32c))
+	return buf, nil
+}
+
+// verifyChecksum checks the trailing checksum of the marshaled form, and
+// returns the marshaled form without it.
+func verifyChecksum(buf []byte, encoding byte) ([]byte, error) {
+	n := len(buf) - checksumSize
+	if n < extHeaderSize {
+		return nil, &DecodeError{Err: ErrInvalidData, Encoding: encoding, Offset: len(buf), Expected: extHeaderSize + checksumSize, Actual: len(buf)}
+	}
+	if crc32.Checksum(buf[:n], crc32c) != binary.LittleEndian.Uint32(buf[n:]) {
+		return nil, &DecodeError{Err: ErrChecksum, Encoding: encoding, Offset: n}
+	}
+	return buf[:n], nil
+}
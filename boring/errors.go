@@ -0,0 +1,71 @@
+package boring
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrOutOfRange is returned for the integers that are not smaller than the
+// nbits of the bitmap.
+var ErrOutOfRange = errors.New("value out of range")
+
+// The errors of the decoders, which are always wrapped in a *DecodeError.
+var (
+	// ErrInvalidData is returned when the data is truncated.
+	ErrInvalidData = errors.New("invalid data")
+	// ErrBadMagic is returned when the data isn't a marshaled bitmap.
+	ErrBadMagic = errors.New("bad magic")
+	// ErrUnsupportedVersion is returned for the unknown versions of the format.
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	// ErrUnsupportedFlags is returned for the unknown flags of the header.
+	ErrUnsupportedFlags = errors.New("unsupported flags")
+	// ErrBadEncoding is returned for the unknown encodings.
+	ErrBadEncoding = errors.New("bad encoding")
+	// ErrSize is returned when the size of the data doesn't match its header.
+	ErrSize = errors.New("unexpected size")
+	// ErrNbits is returned when the data was marshaled with another nbits,
+	// or with more than MaxUnmarshalNbits for the zero value.
+	ErrNbits = errors.New("nbits mismatch")
+	// ErrChecksum is returned when the data doesn't match its checksum.
+	ErrChecksum = errors.New("checksum mismatch")
+
+	// The errors below are only detected with the Validate option.
+
+	// ErrUnsorted is returned when the integers or runs are not sorted and unique.
+	ErrUnsorted = errors.New("values not sorted and unique")
+	// ErrCardinality is returned when the cardinality of the header doesn't match the content.
+	ErrCardinality = errors.New("cardinality does not match the content")
+	// ErrTooLarge is returned when an array or runs don't fit in their
+	// encoding. It is reported even without the Validate option when they
+	// don't fit in the buffer of the bitmap.
+	ErrTooLarge = errors.New("content too large for its encoding")
+)
+
+// DecodeError describes why a marshaled form couldn't be decoded. Err is one
+// of the errors above, which errors.Is matches through Unwrap.
+type DecodeError struct {
+	Err      error
+	Encoding byte // encoding of the header, 0 when unknown
+	Offset   int  // offset in the data where the failure was detected
+
+	// Expected and Actual are sizes in bytes, or numbers of bits for ErrNbits.
+	// They are both zero when they don't apply.
+	Expected int
+	Actual   int
+}
+
+func (e *DecodeError) Error() string {
+	msg := fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+	if e.Encoding != 0 {
+		msg += fmt.Sprintf(" of encoding %#x", e.Encoding)
+	}
+	if e.Expected != e.Actual {
+		msg += fmt.Sprintf(": expected %d, had %d", e.Expected, e.Actual)
+	}
+	return msg
+}
+
+// Unwrap returns Err.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
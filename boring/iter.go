@@ -0,0 +1,42 @@
+//go:build go1.23
+
+package boring
+
+import "iter"
+
+// All returns an iterator over the integers of the bitmap in increasing order.
+func (b *Bitmap) All() iter.Seq[uint32] {
+	return func(yield func(uint32) bool) {
+		for it := b.Iterator(); it.HasNext(); {
+			if !yield(it.Next()) {
+				return
+			}
+		}
+	}
+}
+
+// Backward returns an iterator over the integers of the bitmap in decreasing order.
+func (b *Bitmap) Backward() iter.Seq[uint32] {
+	return func(yield func(uint32) bool) {
+		for it := b.ReverseIterator(); it.HasNext(); {
+			if !yield(it.Next()) {
+				return
+			}
+		}
+	}
+}
+
+// Range returns an iterator over the integers of the bitmap in the range [lo,hi),
+// in increasing order.
+func (b *Bitmap) Range(lo, hi uint32) iter.Seq[uint32] {
+	return func(yield func(uint32) bool) {
+		it := b.Iterator()
+		it.AdvanceIfNeeded(lo)
+		for it.HasNext() {
+			v := it.Next()
+			if v >= hi || !yield(v) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+//go:build go1.23
+
+package boring
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIter(t *testing.T) {
+	b := NewBitmap(nbits)
+	for v := uint32(0); v < uint32(nbits); v += 7 {
+		b.Add(v)
+	}
+	arr := b.ToArray()
+	if b.encoding != encodingBitmap {
+		t.Error("Unexpected encoding: ", b.encoding)
+	}
+
+	var values []uint32
+	for v := range b.All() {
+		values = append(values, v)
+	}
+	if !reflect.DeepEqual(values, arr) {
+		t.Error("Unexpected value: ", values)
+	}
+
+	values = values[:0]
+	for v := range b.Backward() {
+		values = append(values, v)
+		if len(values) == 3 {
+			break
+		}
+	}
+	if !reflect.DeepEqual(values, []uint32{arr[len(arr)-1], arr[len(arr)-2], arr[len(arr)-3]}) {
+		t.Error("Unexpected value: ", values)
+	}
+
+	values = values[:0]
+	for v := range b.Range(10, 30) {
+		values = append(values, v)
+	}
+	if !reflect.DeepEqual(values, []uint32{14, 21, 28}) {
+		t.Error("Unexpected value: ", values)
+	}
+
+	// The array and run encodings.
+	for _, b := range []*Bitmap{NewBitmap(nbits), NewBitmap(nbits)} {
+		b.Add(5)
+		b.Add(40)
+		b.FlipInt(20, 25)
+		values = values[:0]
+		for v := range b.Range(10, 30) {
+			values = append(values, v)
+		}
+		if !reflect.DeepEqual(values, []uint32{20, 21, 22, 23, 24}) {
+			t.Errorf("Unexpected value for encoding %x: %v", b.encoding, values)
+		}
+	}
+}
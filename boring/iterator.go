@@ -0,0 +1,221 @@
+package boring
+
+import "math/bits"
+
+// Iterator walks the integers of a bitmap in increasing order. It reads
+// the content of the bitmap directly, so the bitmap must not be modified
+// while iterating.
+type Iterator struct {
+	encoding byte
+
+	// The array content, or the run index and the next value of that run.
+	content []uint16
+	pos     int
+	value   int
+	run     run
+
+	// The bitmap words.
+	set  []uint64
+	idx  int    // index of the current word
+	word uint64 // bits of the current word not yet returned
+}
+
+// Iterator returns an iterator over the integers of the bitmap.
+func (b *Bitmap) Iterator() *Iterator {
+	it := &Iterator{encoding: b.encoding}
+	switch b.encoding {
+	case encodingArray:
+		it.content = b.array.content
+	case encodingRun:
+		it.run = b.run
+		if it.run.numRuns() > 0 {
+			it.value = it.run.start(0)
+		}
+	default:
+		it.set = b.bitmap.set
+		it.idx = -1
+		it.fill()
+	}
+	return it
+}
+
+// fill moves to the next word with bits not yet returned, if any.
+func (it *Iterator) fill() {
+	for it.word == 0 && it.idx < len(it.set)-1 {
+		it.idx++
+		it.word = it.set[it.idx]
+	}
+}
+
+// HasNext returns true if there are more integers.
+func (it *Iterator) HasNext() bool {
+	switch it.encoding {
+	case encodingArray:
+		return it.pos < len(it.content)
+	case encodingRun:
+		return it.pos < it.run.numRuns()
+	}
+	return it.word != 0
+}
+
+// PeekNext returns the next integer without advancing, HasNext must be true.
+func (it *Iterator) PeekNext() uint32 {
+	switch it.encoding {
+	case encodingArray:
+		return uint32(it.content[it.pos])
+	case encodingRun:
+		return uint32(it.value)
+	}
+	return uint32(it.idx<<log2WordSize + bits.TrailingZeros64(it.word))
+}
+
+// Next returns the next integer, HasNext must be true.
+func (it *Iterator) Next() uint32 {
+	v := it.PeekNext()
+	switch it.encoding {
+	case encodingArray:
+		it.pos++
+	case encodingRun:
+		it.value++
+		if it.value > it.run.last(it.pos) {
+			it.moveToRun(it.pos + 1)
+		}
+	default:
+		it.word &= it.word - 1
+		it.fill()
+	}
+	return v
+}
+
+func (it *Iterator) moveToRun(i int) {
+	it.pos = i
+	if i < it.run.numRuns() {
+		it.value = it.run.start(i)
+	}
+}
+
+// AdvanceIfNeeded skips the integers smaller than min.
+func (it *Iterator) AdvanceIfNeeded(min uint32) {
+	if !it.HasNext() || it.PeekNext() >= min {
+		return
+	}
+	switch it.encoding {
+	case encodingArray:
+		if min > 0xFFFF {
+			it.pos = len(it.content)
+			return
+		}
+		it.pos = advanceUntil(it.content, it.pos-1, len(it.content), uint16(min))
+	case encodingRun:
+		i := it.run.search(int(min))
+		if i >= 0 && int(min) <= it.run.last(i) {
+			it.pos = i
+			it.value = int(min)
+		} else {
+			it.moveToRun(i + 1)
+		}
+	default:
+		idx := int(min >> log2WordSize)
+		if idx >= len(it.set) {
+			it.idx = len(it.set) - 1
+			it.word = 0
+			return
+		}
+		if idx > it.idx {
+			it.idx = idx
+			it.word = it.set[idx]
+		}
+		it.word &= ^uint64(0) << (min & (wordSize - 1))
+		it.fill()
+	}
+}
+
+// ReverseIterator walks the integers of a bitmap in decreasing order. It
+// reads the content of the bitmap directly, so the bitmap must not be
+// modified while iterating.
+type ReverseIterator struct {
+	encoding byte
+
+	// The array content, or the run index and the next value of that run.
+	content []uint16
+	pos     int
+	value   int
+	run     run
+
+	// The bitmap words.
+	set  []uint64
+	idx  int    // index of the current word
+	word uint64 // bits of the current word not yet returned
+}
+
+// ReverseIterator returns an iterator over the integers of the bitmap,
+// starting from the largest.
+func (b *Bitmap) ReverseIterator() *ReverseIterator {
+	it := &ReverseIterator{encoding: b.encoding}
+	switch b.encoding {
+	case encodingArray:
+		it.content = b.array.content
+		it.pos = len(it.content) - 1
+	case encodingRun:
+		it.run = b.run
+		it.moveToRun(it.run.numRuns() - 1)
+	default:
+		it.set = b.bitmap.set
+		it.idx = len(it.set)
+		it.fill()
+	}
+	return it
+}
+
+// fill moves to the previous word with bits not yet returned, if any.
+func (it *ReverseIterator) fill() {
+	for it.word == 0 && it.idx > 0 {
+		it.idx--
+		it.word = it.set[it.idx]
+	}
+}
+
+func (it *ReverseIterator) moveToRun(i int) {
+	it.pos = i
+	if i >= 0 {
+		it.value = it.run.last(i)
+	}
+}
+
+// HasNext returns true if there are more integers.
+func (it *ReverseIterator) HasNext() bool {
+	switch it.encoding {
+	case encodingArray, encodingRun:
+		return it.pos >= 0
+	}
+	return it.word != 0
+}
+
+// PeekNext returns the next integer without advancing, HasNext must be true.
+func (it *ReverseIterator) PeekNext() uint32 {
+	switch it.encoding {
+	case encodingArray:
+		return uint32(it.content[it.pos])
+	case encodingRun:
+		return uint32(it.value)
+	}
+	return uint32(it.idx<<log2WordSize + wordSize - 1 - bits.LeadingZeros64(it.word))
+}
+
+// Next returns the next integer, HasNext must be true.
+func (it *ReverseIterator) Next() uint32 {
+	v := it.PeekNext()
+	switch it.encoding {
+	case encodingArray:
+		it.pos--
+	case encodingRun:
+		it.value--
+		if it.value < it.run.start(it.pos) {
+			it.moveToRun(it.pos - 1)
+		}
+	default:
+		it.word &^= 1 << (v & (wordSize - 1))
+		it.fill()
+	}
+	return v
+}
@@ -0,0 +1,305 @@
+package boring
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var (
+	roaring32Magic = uint32(0xFAD4F032)
+
+	// containerBits is the capacity of the containers of a Roaring32.
+	containerBits = 1 << 16
+)
+
+// Roaring32 is a bitmap over the full uint32 space. The integers are
+// split by their high 16 bits, each of which keys a boring bitmap
+// holding the low 16 bits. Only the non-empty containers are kept.
+type Roaring32 struct {
+	keys       []uint16
+	containers []*Bitmap
+}
+
+// NewRoaring32 returns an empty bitmap.
+func NewRoaring32() *Roaring32 {
+	return &Roaring32{}
+}
+
+// NewRoaring32FromBuf returns a bitmap initialized from the marshaled form.
+// The buffer is always copied.
+func NewRoaring32FromBuf(buf []byte) (*Roaring32, error) {
+	if len(buf) < 12 {
+		return nil, truncated(buf, 12)
+	}
+	if binary.LittleEndian.Uint32(buf) != roaring32Magic {
+		return nil, &DecodeError{Err: ErrBadMagic}
+	}
+	if version := binary.LittleEndian.Uint32(buf[4:]); version != 1 {
+		return nil, &DecodeError{Err: ErrUnsupportedVersion, Offset: 4}
+	}
+	n := int(binary.LittleEndian.Uint32(buf[8:]))
+	r := &Roaring32{}
+	pos := 12
+	for i := 0; i < n; i++ {
+		if len(buf) < pos+8 {
+			return nil, truncated(buf, pos+8)
+		}
+		key := binary.LittleEndian.Uint32(buf[pos:])
+		size := int(binary.LittleEndian.Uint32(buf[pos+4:]))
+		pos += 8
+		if key > 0xFFFF {
+			return nil, &DecodeError{Err: ErrOutOfRange, Offset: pos - 8}
+		}
+		if len(buf) < pos+size {
+			return nil, truncated(buf, pos+size)
+		}
+		if len(r.keys) > 0 && uint16(key) <= r.keys[len(r.keys)-1] {
+			return nil, &DecodeError{Err: ErrUnsorted, Offset: pos - 8}
+		}
+		c, err := NewBitmapFromBuf(buf[pos:pos+size], containerBits, true)
+		if err != nil {
+			var de *DecodeError
+			if errors.As(err, &de) {
+				de.Offset += pos
+			}
+			return nil, err
+		}
+		pos += size
+		if c.IsEmpty() {
+			continue
+		}
+		r.keys = append(r.keys, uint16(key))
+		r.containers = append(r.containers, c)
+	}
+	return r, nil
+}
+
+// Marshal returns a portable binary encoding of the bitmap:
+// magic uint32 | version uint32 | containers uint32
+// followed for each container by
+// key uint32 | size uint32 | marshaled container
+// all little-endian.
+func (r *Roaring32) Marshal() ([]byte, error) {
+	buf := make([]byte, 12)
+	binary.LittleEndian.PutUint32(buf, roaring32Magic)
+	binary.LittleEndian.PutUint32(buf[4:], 1)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(r.keys)))
+	for i, c := range r.containers {
+		data, err := c.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		var prefix [8]byte
+		binary.LittleEndian.PutUint32(prefix[:], uint32(r.keys[i]))
+		binary.LittleEndian.PutUint32(prefix[4:], uint32(len(data)))
+		buf = append(buf, prefix[:]...)
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+// search returns the index of the container for the key, and whether it exists.
+func (r *Roaring32) search(key uint16) (int, bool) {
+	i := sort.Search(len(r.keys), func(i int) bool { return r.keys[i] >= key })
+	return i, i < len(r.keys) && r.keys[i] == key
+}
+
+func (r *Roaring32) insert(i int, key uint16, c *Bitmap) {
+	r.keys = append(r.keys, 0)
+	copy(r.keys[i+1:], r.keys[i:])
+	r.keys[i] = key
+	r.containers = append(r.containers, nil)
+	copy(r.containers[i+1:], r.containers[i:])
+	r.containers[i] = c
+}
+
+func (r *Roaring32) delete(i int) {
+	r.keys = append(r.keys[:i], r.keys[i+1:]...)
+	r.containers = append(r.containers[:i], r.containers[i+1:]...)
+}
+
+// Add the integer x to the bitmap.
+func (r *Roaring32) Add(v uint32) {
+	i, ok := r.search(uint16(v >> 16))
+	if !ok {
+		r.insert(i, uint16(v>>16), NewBitmap(containerBits))
+	}
+	r.containers[i].Add(v & 0xFFFF)
+}
+
+// AddInt adds the integer x to the bitmap (convenience method: the parameter is casted to uint32 and we call Add).
+func (r *Roaring32) AddInt(v int) {
+	r.Add(uint32(v))
+}
+
+// Remove the integer x from the bitmap.
+func (r *Roaring32) Remove(v uint32) {
+	i, ok := r.search(uint16(v >> 16))
+	if !ok {
+		return
+	}
+	r.containers[i].Remove(v & 0xFFFF)
+	if r.containers[i].IsEmpty() {
+		r.delete(i)
+	}
+}
+
+// Contains returns true if the integer is contained in the bitmap.
+func (r *Roaring32) Contains(v uint32) bool {
+	i, ok := r.search(uint16(v >> 16))
+	return ok && r.containers[i].Contains(v&0xFFFF)
+}
+
+// And computes the intersection between two bitmaps and stores the result in the current bitmap.
+func (r *Roaring32) And(o *Roaring32) {
+	if r == o || o == nil {
+		return
+	}
+	keys := r.keys[:0]
+	containers := r.containers[:0]
+	for i, key := range r.keys {
+		j, ok := o.search(key)
+		if !ok {
+			continue
+		}
+		c := r.containers[i]
+		c.And(o.containers[j])
+		if !c.IsEmpty() {
+			keys = append(keys, key)
+			containers = append(containers, c)
+		}
+	}
+	r.keys = keys
+	r.containers = containers
+}
+
+// Or computes the union between two bitmaps and stores the result in the current bitmap.
+func (r *Roaring32) Or(o *Roaring32) {
+	if r == o || o == nil {
+		return
+	}
+	for j, key := range o.keys {
+		i, ok := r.search(key)
+		if ok {
+			r.containers[i].Or(o.containers[j])
+		} else {
+			r.insert(i, key, o.containers[j].Clone())
+		}
+	}
+}
+
+// AndNot computes the difference between two bitmaps and stores the result in the current bitmap.
+func (r *Roaring32) AndNot(o *Roaring32) {
+	if o == nil {
+		return
+	}
+	if r == o {
+		r.keys = nil
+		r.containers = nil
+		return
+	}
+	keys := r.keys[:0]
+	containers := r.containers[:0]
+	for i, key := range r.keys {
+		c := r.containers[i]
+		if j, ok := o.search(key); ok {
+			c.AndNot(o.containers[j])
+		}
+		if !c.IsEmpty() {
+			keys = append(keys, key)
+			containers = append(containers, c)
+		}
+	}
+	r.keys = keys
+	r.containers = containers
+}
+
+// Xor computes the symmetric difference between two bitmaps and stores the result in the current bitmap.
+func (r *Roaring32) Xor(o *Roaring32) {
+	if o == nil {
+		return
+	}
+	if r == o {
+		r.keys = nil
+		r.containers = nil
+		return
+	}
+	for j, key := range o.keys {
+		i, ok := r.search(key)
+		if !ok {
+			r.insert(i, key, o.containers[j].Clone())
+			continue
+		}
+		r.containers[i].Xor(o.containers[j])
+		if r.containers[i].IsEmpty() {
+			r.delete(i)
+		}
+	}
+}
+
+// Equals returns true if the two bitmaps hold the same integers.
+func (r *Roaring32) Equals(o *Roaring32) bool {
+	if o == nil {
+		return false
+	}
+	if len(r.keys) != len(o.keys) {
+		return false
+	}
+	for i, key := range r.keys {
+		if key != o.keys[i] || !r.containers[i].Equals(o.containers[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone creates a copy of the bitmap.
+func (r *Roaring32) Clone() *Roaring32 {
+	c := &Roaring32{
+		keys:       make([]uint16, len(r.keys)),
+		containers: make([]*Bitmap, len(r.containers)),
+	}
+	copy(c.keys, r.keys)
+	for i, b := range r.containers {
+		c.containers[i] = b.Clone()
+	}
+	return c
+}
+
+// Iterate calls cb for each integer of the bitmap in sorted order,
+// stopping when cb returns false.
+func (r *Roaring32) Iterate(cb func(x uint32) bool) {
+	for i, c := range r.containers {
+		high := uint32(r.keys[i]) << 16
+		for it := c.Iterator(); it.HasNext(); {
+			if !cb(high | it.Next()) {
+				return
+			}
+		}
+	}
+}
+
+// ToArray returns all of the integers stored in the bitmap in sorted order.
+func (r *Roaring32) ToArray() []uint32 {
+	arr := make([]uint32, 0, r.GetCardinality())
+	r.Iterate(func(x uint32) bool {
+		arr = append(arr, x)
+		return true
+	})
+	return arr
+}
+
+// GetCardinality returns the number of integers contained in the bitmap.
+func (r *Roaring32) GetCardinality() uint64 {
+	cnt := uint64(0)
+	for _, c := range r.containers {
+		cnt += c.GetCardinality()
+	}
+	return cnt
+}
+
+// IsEmpty returns true if the bitmap is empty.
+func (r *Roaring32) IsEmpty() bool {
+	return len(r.keys) == 0
+}
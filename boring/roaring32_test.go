@@ -0,0 +1,162 @@
+package boring
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRoaring32(t *testing.T) {
+	r := NewRoaring32()
+	values := []uint32{0, 1, 65535, 65536, 1 << 20, 0xFFFFFFFF}
+	for _, v := range values {
+		r.Add(v)
+	}
+	r.Add(65536)
+	for _, v := range values {
+		if !r.Contains(v) {
+			t.Errorf("expected %d to be present", v)
+		}
+	}
+	if r.Contains(2) || r.Contains(1<<20+1) {
+		t.Error("unexpected value present")
+	}
+	if r.GetCardinality() != uint64(len(values)) {
+		t.Error("Unexpected cardinality: ", r.GetCardinality())
+	}
+	if !reflect.DeepEqual(r.ToArray(), values) {
+		t.Error("Unexpected value: ", r.ToArray())
+	}
+	if len(r.keys) != 4 {
+		t.Error("Unexpected containers: ", r.keys)
+	}
+
+	r.Remove(1 << 20)
+	r.Remove(12345)
+	if len(r.keys) != 3 {
+		t.Error("empty containers should be removed: ", r.keys)
+	}
+
+	var seen []uint32
+	r.Iterate(func(x uint32) bool {
+		seen = append(seen, x)
+		return len(seen) < 3
+	})
+	if !reflect.DeepEqual(seen, []uint32{0, 1, 65535}) {
+		t.Error("Unexpected iteration: ", seen)
+	}
+}
+
+func TestRoaring32Marshal(t *testing.T) {
+	r := NewRoaring32()
+	for v := uint32(0); v < 100000; v += 7 {
+		r.Add(v)
+	}
+	for v := uint32(3 << 30); v < 3<<30+5000; v++ {
+		r.Add(v)
+	}
+	r.Add(0xFFFFFFFF)
+	buf, err := r.Marshal()
+	if err != nil {
+		t.Error("Error marshalling: ", err)
+		return
+	}
+	r1, err := NewRoaring32FromBuf(buf)
+	if err != nil {
+		t.Error("Error unmarshalling: ", err)
+		return
+	}
+	if !r1.Equals(r) || !reflect.DeepEqual(r1.ToArray(), r.ToArray()) {
+		t.Error("bitmaps should be equal")
+	}
+
+	if _, err := NewRoaring32FromBuf(buf[:len(buf)-1]); err == nil {
+		t.Error("truncated data should be rejected")
+	}
+
+	// The offsets of the errors in a container are from the start of buf.
+	bad := append([]byte(nil), buf...)
+	bad[20+4] ^= 0xFF
+	_, err = NewRoaring32FromBuf(bad)
+	var de *DecodeError
+	if !errors.As(err, &de) || !errors.Is(err, ErrBadMagic) || de.Offset != 20+4 {
+		t.Error("Unexpected error: ", err)
+	}
+}
+
+func TestRoaring32Random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) (*Roaring32, map[uint32]bool) {
+		b := NewRoaring32()
+		m := map[uint32]bool{}
+		for i := 0; i < n; i++ {
+			// A few containers, some of them dense.
+			v := uint32(r.Intn(4))<<28 | uint32(r.Intn(1<<17))
+			b.Add(v)
+			m[v] = true
+		}
+		return b, m
+	}
+	for i := 0; i < 40; i++ {
+		a, ma := random([]int{100, 5000, 50000}[i%3])
+		b, mb := random([]int{100, 5000, 50000}[(i/3)%3])
+		expected := map[uint32]bool{}
+
+		c := a.Clone()
+		switch i % 4 {
+		case 0:
+			c.And(b)
+			for v := range ma {
+				if mb[v] {
+					expected[v] = true
+				}
+			}
+		case 1:
+			c.Or(b)
+			for v := range ma {
+				expected[v] = true
+			}
+			for v := range mb {
+				expected[v] = true
+			}
+		case 2:
+			c.AndNot(b)
+			for v := range ma {
+				if !mb[v] {
+					expected[v] = true
+				}
+			}
+		case 3:
+			c.Xor(b)
+			for v := range ma {
+				if !mb[v] {
+					expected[v] = true
+				}
+			}
+			for v := range mb {
+				if !ma[v] {
+					expected[v] = true
+				}
+			}
+		}
+		arr := make([]uint32, 0, len(expected))
+		for v := range expected {
+			arr = append(arr, v)
+		}
+		sort.Slice(arr, func(i, j int) bool { return arr[i] < arr[j] })
+		if !reflect.DeepEqual(c.ToArray(), arr) {
+			t.Errorf("%d: unexpected result", i)
+			return
+		}
+		if c.GetCardinality() != uint64(len(arr)) {
+			t.Errorf("%d: expected cardinality %d, but had %d", i, len(arr), c.GetCardinality())
+			return
+		}
+		if a.GetCardinality() != uint64(len(ma)) || b.GetCardinality() != uint64(len(mb)) {
+			t.Errorf("%d: operands should not change", i)
+			return
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package boring
+
+// run stores the integers as sorted, non-overlapping and non-adjacent runs.
+// Each run is a pair of uint16, the start of the run and its length, where
+// the length is the number of integers in the run minus one so that a
+// single run can cover all 65536 values.
+type run struct {
+	buf         []byte
+	content     []uint16 // start, length pairs
+	cardinality int
+	sz          int
+}
+
+func (r *run) numRuns() int {
+	return len(r.content) / 2
+}
+
+func (r *run) start(i int) int {
+	return int(r.content[2*i])
+}
+
+// last returns the last integer of the run i.
+func (r *run) last(i int) int {
+	return int(r.content[2*i]) + int(r.content[2*i+1])
+}
+
+// search returns the index of the last run starting at or before v, or -1.
+func (r *run) search(v int) int {
+	low := 0
+	high := r.numRuns() - 1
+	for low <= high {
+		middle := int(uint32(low+high) >> 1)
+		if r.start(middle) <= v {
+			low = middle + 1
+		} else {
+			high = middle - 1
+		}
+	}
+	return low - 1
+}
+
+func (r *run) contains(v uint32) bool {
+	i := r.search(int(v))
+	return i >= 0 && int(v) <= r.last(i)
+}
+
+func (r *run) add(v uint32) {
+	x := int(v)
+	i := r.search(x)
+	if i >= 0 && x <= r.last(i) {
+		return
+	}
+	r.cardinality++
+	n := r.numRuns()
+	if i >= 0 && x == r.last(i)+1 {
+		r.content[2*i+1]++
+		if i+1 < n && r.start(i+1) == x+1 {
+			// Merge with the next run.
+			r.content[2*i+1] += r.content[2*i+3] + 1
+			r.removeRun(i + 1)
+		}
+		return
+	}
+	if i+1 < n && r.start(i+1) == x+1 {
+		r.content[2*i+2]--
+		r.content[2*i+3]++
+		return
+	}
+	r.insertRun(i+1, x, 0)
+}
+
+func (r *run) remove(v uint32) {
+	x := int(v)
+	i := r.search(x)
+	if i < 0 || x > r.last(i) {
+		return
+	}
+	r.cardinality--
+	start, last := r.start(i), r.last(i)
+	switch {
+	case start == last:
+		r.removeRun(i)
+	case x == start:
+		r.content[2*i]++
+		r.content[2*i+1]--
+	case x == last:
+		r.content[2*i+1]--
+	default:
+		r.content[2*i+1] = uint16(x - 1 - start)
+		r.insertRun(i+1, x+1, last-x-1)
+	}
+}
+
+func (r *run) insertRun(i int, start int, length int) {
+	s := append(r.content, 0, 0)
+	copy(s[2*i+2:], s[2*i:])
+	s[2*i] = uint16(start)
+	s[2*i+1] = uint16(length)
+	r.content = s
+}
+
+func (r *run) removeRun(i int) {
+	r.content = append(r.content[:2*i], r.content[2*i+2:]...)
+}
+
+// replaceRuns replaces the runs [i,j) with the start, length pairs.
+func (r *run) replaceRuns(i, j int, pairs ...uint16) {
+	tail := append([]uint16(nil), r.content[2*j:]...)
+	r.content = append(append(r.content[:2*i], pairs...), tail...)
+}
+
+// cardinalityOfRuns returns the number of integers in the runs [i,j).
+func (r *run) cardinalityOfRuns(i, j int) int {
+	cnt := 0
+	for k := i; k < j; k++ {
+		cnt += int(r.content[2*k+1]) + 1
+	}
+	return cnt
+}
+
+// addRange adds the integers in [start,stop).
+func (r *run) addRange(start, stop int) {
+	last := stop - 1
+	// The runs [i,j) overlap or are adjacent to the range, they're merged with it.
+	i := r.search(start - 1)
+	if i < 0 || r.last(i) < start-1 {
+		i++
+	}
+	j := r.search(stop) + 1
+	if i < j {
+		start = min(start, r.start(i))
+		last = max(last, r.last(j-1))
+	}
+	r.cardinality += last - start + 1 - r.cardinalityOfRuns(i, j)
+	r.replaceRuns(i, j, uint16(start), uint16(last-start))
+}
+
+// removeRange removes the integers in [start,stop).
+func (r *run) removeRange(start, stop int) {
+	// The runs [i,j) overlap the range, only their parts outside of it are kept.
+	i := r.search(start)
+	if i < 0 || r.last(i) < start {
+		i++
+	}
+	j := r.search(stop-1) + 1
+	if i >= j {
+		return
+	}
+	var pairs []uint16
+	if first := r.start(i); first < start {
+		pairs = append(pairs, uint16(first), uint16(start-1-first))
+	}
+	if last := r.last(j - 1); last >= stop {
+		pairs = append(pairs, uint16(stop), uint16(last-stop))
+	}
+	r.cardinality -= r.cardinalityOfRuns(i, j)
+	for k := 1; k < len(pairs); k += 2 {
+		r.cardinality += int(pairs[k]) + 1
+	}
+	r.replaceRuns(i, j, pairs...)
+}
+
+// cardinalityInRange returns the number of integers in [start,stop).
+func (r *run) cardinalityInRange(start, stop int) int {
+	cnt := 0
+	i := max(r.search(start), 0)
+	for ; i < r.numRuns() && r.start(i) < stop; i++ {
+		if n := min(r.last(i)+1, stop) - max(r.start(i), start); n > 0 {
+			cnt += n
+		}
+	}
+	return cnt
+}
+
+// containsAllInRange returns true if all the integers of [start,stop) are
+// present, the runs not being adjacent a single one must cover the range.
+func (r *run) containsAllInRange(start, stop int) bool {
+	if start >= stop {
+		return true
+	}
+	i := r.search(start)
+	return i >= 0 && r.last(i) >= stop-1
+}
+
+func (r *run) rank(v uint32) int {
+	x := int(v)
+	cnt := 0
+	for i := 0; i < r.numRuns(); i++ {
+		start, last := r.start(i), r.last(i)
+		if x < start {
+			break
+		}
+		if x <= last {
+			return cnt + x - start + 1
+		}
+		cnt += last - start + 1
+	}
+	return cnt
+}
+
+func (r *run) selectInt(k int) uint32 {
+	for i := 0; i < r.numRuns(); i++ {
+		l := r.last(i) - r.start(i) + 1
+		if k < l {
+			return uint32(r.start(i) + k)
+		}
+		k -= l
+	}
+	return 0
+}
+
+func (r *run) computeCardinality() int {
+	cnt := 0
+	for i := 0; i < r.numRuns(); i++ {
+		cnt += int(r.content[2*i+1]) + 1
+	}
+	return cnt
+}
+
+// fromSorted replaces the content with the runs of the sorted integers.
+func (r *run) fromSorted(data []uint16) {
+	content := make([]uint16, 0, 2*numberOfRuns(data))
+	for i := 0; i < len(data); {
+		j := i + 1
+		for j < len(data) && data[j] == data[j-1]+1 {
+			j++
+		}
+		content = append(content, data[i], uint16(j-i-1))
+		i = j
+	}
+	r.content = toUint16Slice(r.buf[extHeaderSize:], len(content))
+	copy(r.content, content)
+	r.cardinality = len(data)
+}
+
+func (r *run) nextSetMany16(buffer []uint16) {
+	pos := 0
+	for i := 0; i < r.numRuns(); i++ {
+		for v := r.start(i); v <= r.last(i); v++ {
+			buffer[pos] = uint16(v)
+			pos++
+		}
+	}
+}
+
+func (r *run) nextSetMany32(buffer []uint32) {
+	pos := 0
+	for i := 0; i < r.numRuns(); i++ {
+		for v := r.start(i); v <= r.last(i); v++ {
+			buffer[pos] = uint32(v)
+			pos++
+		}
+	}
+}
+
+// nextMany appends the integers larger or equal to i in increasing order, up to limit.
+func (r *run) nextMany(i uint32, buffer []uint32, limit int) ([]uint32, bool) {
+	size := 0
+	k := r.search(int(i))
+	if k < 0 {
+		k = 0
+	}
+	for ; k < r.numRuns(); k++ {
+		v := r.start(k)
+		if int(i) > v {
+			v = int(i)
+		}
+		for ; v <= r.last(k); v++ {
+			buffer = append(buffer, uint32(v))
+			size++
+			if size == limit {
+				return buffer, true
+			}
+		}
+	}
+	return buffer, false
+}
+
+// prevMany appends the integers smaller or equal to i in decreasing order, up to limit.
+func (r *run) prevMany(i uint32, buffer []uint32, limit int) ([]uint32, bool) {
+	size := 0
+	for k := r.search(int(i)); k >= 0; k-- {
+		v := r.last(k)
+		if int(i) < v {
+			v = int(i)
+		}
+		for ; v >= r.start(k); v-- {
+			buffer = append(buffer, uint32(v))
+			size++
+			if size == limit {
+				return buffer, true
+			}
+		}
+	}
+	return buffer, false
+}
+
+func (r *run) andCardinality(o run) int {
+	cnt := 0
+	i, j := 0, 0
+	for i < r.numRuns() && j < o.numRuns() {
+		lo := max(r.start(i), o.start(j))
+		hi := min(r.last(i), o.last(j))
+		if lo <= hi {
+			cnt += hi - lo + 1
+		}
+		if r.last(i) < o.last(j) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return cnt
+}
+
+func (r *run) andCardinalityArray(o array) int {
+	cnt := 0
+	for _, v := range o.content {
+		if r.contains(uint32(v)) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (r *run) andCardinalityBitmap(o bitmap) int {
+	cnt := 0
+	for i := 0; i < r.numRuns(); i++ {
+		cnt += o.cardinalityInRange(r.start(i), r.last(i)+1)
+	}
+	return cnt
+}
+
+func (r *run) intersects(o run) bool {
+	i, j := 0, 0
+	for i < r.numRuns() && j < o.numRuns() {
+		if max(r.start(i), o.start(j)) <= min(r.last(i), o.last(j)) {
+			return true
+		}
+		if r.last(i) < o.last(j) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return false
+}
+
+func (r *run) intersectsArray(o array) bool {
+	for _, v := range o.content {
+		if r.contains(uint32(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *run) intersectsBitmap(o bitmap) bool {
+	for i := 0; i < r.numRuns(); i++ {
+		if o.cardinalityInRange(r.start(i), r.last(i)+1) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *run) equals(o run) bool {
+	if len(r.content) != len(o.content) {
+		return false
+	}
+	for i := range r.content {
+		if r.content[i] != o.content[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// equalsArray expects both to have the same cardinality.
+func (r *run) equalsArray(o array) bool {
+	for _, v := range o.content {
+		if !r.contains(uint32(v)) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalsBitmap expects both to have the same cardinality.
+func (r *run) equalsBitmap(o bitmap) bool {
+	for i := 0; i < r.numRuns(); i++ {
+		if o.cardinalityInRange(r.start(i), r.last(i)+1) != r.last(i)-r.start(i)+1 {
+			return false
+		}
+	}
+	return true
+}
+
+// numberOfRuns returns the number of runs in the sorted integers.
+func numberOfRuns(data []uint16) int {
+	if len(data) == 0 {
+		return 0
+	}
+	nruns := 1
+	for i := 1; i < len(data); i++ {
+		if data[i] != data[i-1]+1 {
+			nruns++
+		}
+	}
+	return nruns
+}
+
+func max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,61 @@
+package boring
+
+import "math/bits"
+
+// validateArray checks that the integers are sorted, unique and smaller than
+// nbits, it returns the index of the first invalid one.
+func validateArray[T uint16 | uint32](data []T, nbits int) (int, error) {
+	for i := 1; i < len(data); i++ {
+		if data[i] <= data[i-1] {
+			return i, ErrUnsorted
+		}
+	}
+	if l := len(data); l > 0 && int64(data[l-1]) >= int64(nbits) {
+		return l - 1, ErrOutOfRange
+	}
+	return 0, nil
+}
+
+// validateWords checks that no bit is set past nbits and that the cardinality
+// of the header matches the bits set, it returns the index of the first
+// invalid word. Legacy headers only hold the cardinality modulo 65536.
+func validateWords(set []uint64, nbits int, cardinality uint32, legacy bool) (int, error) {
+	for i := nbits >> log2WordSize; i < len(set); i++ {
+		w := set[i]
+		if i == nbits>>log2WordSize {
+			w &^= ^(^uint64(0) << (nbits & (wordSize - 1)))
+		}
+		if w != 0 {
+			return i, ErrOutOfRange
+		}
+	}
+	cnt := 0
+	for _, w := range set {
+		cnt += bits.OnesCount64(w)
+	}
+	if legacy {
+		cnt &= 0xFFFF
+	}
+	if uint32(cnt) != cardinality {
+		return 0, ErrCardinality
+	}
+	return 0, nil
+}
+
+// validateRuns checks that the runs are sorted, neither overlap nor touch,
+// and end before nbits, it returns the index of the first invalid one.
+func validateRuns(content []uint16, nbits int) (int, error) {
+	prev := -2
+	for i := 0; i+1 < len(content); i += 2 {
+		start := int(content[i])
+		last := start + int(content[i+1])
+		if start <= prev+1 {
+			return i / 2, ErrUnsorted
+		}
+		if last > 0xFFFF || last >= nbits {
+			return i / 2, ErrOutOfRange
+		}
+		prev = last
+	}
+	return 0, nil
+}
@@ -1,23 +1,41 @@
 package fixed
 
 import (
-	"errors"
-	"fmt"
+	"encoding/binary"
 	"math/bits"
 	"reflect"
 	"unsafe"
 )
 
-// Note that the marshaled form of the bitmap is not portable -- it is assumed to be the
-// same endianness as the machine that created the marshaled form
+// Marshal produces the portable form of the bitmap, which is always little-endian.
+// Bytes exposes the internal buffer which is in the native byte order of the host,
+// and is tagged with the legacy encodings. NewBitmapFromBuf reads both.
 var (
 	arrayMax = 1000
 
+	// headerSize is the size of the legacy and version 1 headers.
 	headerSize = 8
+	// extHeaderSize is the size of the version 2 header, which has room
+	// for a 32 bit cardinality and the number of bits.
+	extHeaderSize = 16
 
-	bitmapMagic    = uint32(0xFAD4F00D)
+	bitmapMagic = uint32(0xFAD4F00D)
+
+	// Legacy encodings, the data is in the byte order of the host that wrote it.
 	encodingBitmap = byte(0xF0)
 	encodingArray  = byte(0x0F)
+
+	// Portable encodings, the header and data are always little-endian.
+	encodingBitmapLE = byte(0xF1)
+	encodingArrayLE  = byte(0x1F)
+
+	// The array of uint32 encoding is used when the values don't fit in
+	// a uint16, it only has a portable form.
+	encodingArray32LE = byte(0x2F)
+	array16Bits       = 1 << 16
+
+	// formatVersion is stored in the header of the portable encodings.
+	formatVersion = byte(2)
 )
 
 // We're not going to range check here as we'd rather have a crash than a silent corruption.
@@ -33,114 +51,260 @@ const (
 type Bitmap struct {
 	// Underlying storage for the header and the bitset.
 	// header bytes | bits
+	// The header has room for the version 2 header, so marshaled forms
+	// can be used in place. Bytes writes the legacy header to its second half.
 	buf         []byte
 	set         []uint64
 	cardinality int
 	nbits       int
+	strict      bool
+	jsonArray   bool
 }
 
 // NewBitmap returns a fixed size bitmap with a capacity for nbits of storage.
-func NewBitmap(nbits int) *Bitmap {
+func NewBitmap(nbits int, opts ...Option) *Bitmap {
+	o := newOptions(opts)
 	totalSize := totalSize(nbits)
 	buf := make([]byte, totalSize)
 	return &Bitmap{
 		buf:         buf,
-		set:         toUint64Slice(buf[headerSize:]),
+		set:         toUint64Slice(buf[extHeaderSize:]),
 		cardinality: 0,
 		nbits:       nbits,
+		strict:      o.strict,
+		jsonArray:   o.jsonArray,
 	}
 }
 
 // NewBitmapFromBuf returns a fixed size bitmap with a capacity for nbits of storage.
 // The bitmap is initialized from the marshaled form. If copyBuffer is true, the buffer
-// is copied, otherwise it may be used by the bitmap itself.
-func NewBitmapFromBuf(buf []byte, nbits int, copyBuffer bool) (*Bitmap, error) {
+// is copied, otherwise it may be used by the bitmap itself. The marshaled form is
+// trusted unless the Validate option is given.
+func NewBitmapFromBuf(buf []byte, nbits int, copyBuffer bool, opts ...Option) (*Bitmap, error) {
+	o := newOptions(opts)
 	if len(buf) < headerSize {
-		return nil, errors.New("invalid data")
+		return nil, &DecodeError{Err: ErrInvalidData, Offset: len(buf), Expected: headerSize, Actual: len(buf)}
 	}
 	var h header
 	h.read(buf)
 	if h.magic != bitmapMagic {
-		return nil, errors.New("bad magic")
+		return nil, &DecodeError{Err: ErrBadMagic, Offset: 4}
 	}
+	encoding := h.encoding
 
-	totalSize := totalSize(nbits)
+	hsize := headerSize
+	switch h.encoding {
+	case encodingBitmapLE, encodingArrayLE, encodingArray32LE:
+		switch h.version {
+		case 1:
+		case formatVersion:
+			hsize = extHeaderSize
+			if len(buf) < hsize {
+				return nil, &DecodeError{Err: ErrInvalidData, Encoding: encoding, Offset: len(buf), Expected: hsize, Actual: len(buf)}
+			}
+			h.readExt(buf)
+			if h.flags&^flagChecksum != 0 {
+				return nil, &DecodeError{Err: ErrUnsupportedFlags, Encoding: encoding}
+			}
+			if h.flags&flagChecksum != 0 {
+				var err error
+				if buf, err = verifyChecksum(buf, encoding); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, &DecodeError{Err: ErrUnsupportedVersion, Encoding: encoding, Offset: 2}
+		}
+		if !littleEndian {
+			buf = toNativeEndian(buf, h.encoding, hsize)
+			copyBuffer = false
+		}
+		h.encoding = legacyEncoding(h.encoding)
+	}
+
+	bodySize := bodySize(nbits)
 	switch h.encoding {
 	case encodingBitmap:
-		if len(buf) != totalSize {
-			return nil, fmt.Errorf("bitmap expects %d bytes", totalSize)
+		if len(buf) != hsize+bodySize {
+			return nil, &DecodeError{Err: ErrSize, Encoding: encoding, Offset: len(buf), Expected: hsize + bodySize, Actual: len(buf)}
+		}
+		if hsize == extHeaderSize && int(h.nbits) != nbits {
+			return nil, &DecodeError{Err: ErrNbits, Encoding: encoding, Offset: 12, Expected: nbits, Actual: int(h.nbits)}
 		}
-		if copyBuffer {
-			dst := make([]byte, totalSize)
-			copy(dst, buf)
+		if copyBuffer || hsize != extHeaderSize {
+			dst := make([]byte, extHeaderSize+bodySize)
+			copy(dst[extHeaderSize:], buf[hsize:])
 			buf = dst
 		}
 
-		return &Bitmap{
+		b := &Bitmap{
 			buf:         buf,
-			set:         toUint64Slice(buf[headerSize:]),
+			set:         toUint64Slice(buf[extHeaderSize:]),
 			cardinality: int(h.cardinality),
 			nbits:       nbits,
-		}, nil
+			strict:      o.strict,
+			jsonArray:   o.jsonArray,
+		}
+		if hsize == headerSize {
+			// Older headers truncate the cardinality to 16 bits.
+			b.cardinality = int(b.computeCardinality())
+		}
+		if o.validate {
+			if i, err := validateWords(b.set, nbits, h.cardinality, hsize == headerSize); err != nil {
+				return nil, &DecodeError{Err: err, Encoding: encoding, Offset: hsize + i*8}
+			}
+		}
+		return b, nil
 
 	case encodingArray:
-		b := NewBitmap(nbits)
-		if len(buf[headerSize:])/2 != int(h.cardinality) {
-			return nil, fmt.Errorf("array encoding expects %d bytes", h.cardinality*2)
+		b := NewBitmap(nbits, opts...)
+		if len(buf) != hsize+int(h.cardinality)*2 {
+			return nil, &DecodeError{Err: ErrSize, Encoding: encoding, Offset: len(buf), Expected: hsize + int(h.cardinality)*2, Actual: len(buf)}
 		}
 		if h.cardinality > 0 {
-			data := toUint16Slice(buf[headerSize:], int(h.cardinality))
+			data := toUint16Slice(buf[hsize:], int(h.cardinality))
+			if o.validate {
+				if i, err := validateArray(data, nbits); err != nil {
+					return nil, &DecodeError{Err: err, Encoding: encoding, Offset: hsize + i*2}
+				}
+			}
 			for _, v := range data {
 				b.Add(uint32(v))
 			}
 		}
 		return b, nil
+
+	case encodingArray32LE:
+		b := NewBitmap(nbits, opts...)
+		if len(buf) != hsize+int(h.cardinality)*4 {
+			return nil, &DecodeError{Err: ErrSize, Encoding: encoding, Offset: len(buf), Expected: hsize + int(h.cardinality)*4, Actual: len(buf)}
+		}
+		if h.cardinality > 0 {
+			data := toUint32Slice(buf[hsize:], int(h.cardinality))
+			if o.validate {
+				if i, err := validateArray(data, nbits); err != nil {
+					return nil, &DecodeError{Err: err, Encoding: encoding, Offset: hsize + i*4}
+				}
+			}
+			for i, v := range data {
+				if int(v) >= nbits {
+					return nil, &DecodeError{Err: ErrOutOfRange, Encoding: encoding, Offset: hsize + i*4}
+				}
+				b.Add(v)
+			}
+		}
+		return b, nil
 	}
 
-	return nil, fmt.Errorf("bad encoding")
+	return nil, &DecodeError{Err: ErrBadEncoding, Encoding: encoding, Offset: 3}
 }
 
-// Bytes returns a pointer to the content of the bitmap.
+// Bytes returns a pointer to the content of the bitmap. The content
+// is in the native byte order of the host, use Marshal for a portable
+// form.
 func (b *Bitmap) Bytes() []byte {
 	var header = header{
 		magic:       bitmapMagic,
 		encoding:    encodingBitmap,
-		cardinality: uint16(b.GetCardinality()),
+		cardinality: uint32(b.GetCardinality()),
 	}
-	header.write(b.buf)
-	return b.buf
+	buf := b.buf[extHeaderSize-headerSize:]
+	header.write(buf)
+	return buf
 }
 
-// Marshal returns a binary encoding of the bitmap. The data
-// returned may point to the internals of the bitmap itself,
-// and if the bitmap is subsequently changed the marshaled form
-// may change.
+// Marshal returns a portable binary encoding of the bitmap. The data
+// is a copy, unlike Bytes, whose header shares the storage of the
+// bitmap with the one written by Marshal.
 func (b *Bitmap) Marshal() ([]byte, error) {
-	l := int(b.GetCardinality())
+	if header, ok := b.wordsHeader(); ok {
+		buf := make([]byte, len(b.buf))
+		header.writeLE(buf)
+		if littleEndian {
+			copy(buf[extHeaderSize:], b.buf[extHeaderSize:])
+			return buf, nil
+		}
+		for i, v := range b.set {
+			binary.LittleEndian.PutUint64(buf[extHeaderSize+i*8:], v)
+		}
+		return buf, nil
+	}
 
-	if l >= arrayMax {
-		return b.Bytes(), nil
+	if b.nbits > array16Bits {
+		return b.marshalArray32(), nil
 	}
 
-	buf := make([]byte, headerSize+l*2)
+	l := int(b.GetCardinality())
+	buf := make([]byte, extHeaderSize+l*2)
 	var header = header{
 		magic:       bitmapMagic,
-		encoding:    encodingArray,
-		cardinality: uint16(l),
+		encoding:    encodingArrayLE,
+		version:     formatVersion,
+		cardinality: uint32(l),
+		nbits:       uint32(b.nbits),
 	}
-	header.write(buf)
+	header.writeLE(buf)
 	if l > 0 {
-		data := toUint16Slice(buf[headerSize:], l)
+		data := toUint16Slice(buf[extHeaderSize:], l)
 		b.nextSetMany16(data)
+		if !littleEndian {
+			for i, v := range data {
+				data[i] = bits.ReverseBytes16(v)
+			}
+		}
 	}
 	return buf, nil
 }
 
+// wordsHeader returns the header of the bitmap encoding, or false if
+// Marshal uses an array encoding.
+func (b *Bitmap) wordsHeader() (header, bool) {
+	l := int(b.GetCardinality())
+	if b.nbits > array16Bits && l*4 < len(b.set)*8 {
+		// The values don't fit in a uint16, use a uint32 array while it's
+		// smaller than the bitmap.
+		return header{}, false
+	}
+	return header{
+		magic:       bitmapMagic,
+		encoding:    encodingBitmapLE,
+		version:     formatVersion,
+		cardinality: uint32(l),
+		nbits:       uint32(b.nbits),
+	}, l >= arrayMax
+}
+
+// marshalArray32 returns the array encoding for values that don't fit in a uint16.
+func (b *Bitmap) marshalArray32() []byte {
+	l := int(b.GetCardinality())
+	buf := make([]byte, extHeaderSize+l*4)
+	var header = header{
+		magic:       bitmapMagic,
+		encoding:    encodingArray32LE,
+		version:     formatVersion,
+		cardinality: uint32(l),
+		nbits:       uint32(b.nbits),
+	}
+	header.writeLE(buf)
+	if l > 0 {
+		data := toUint32Slice(buf[extHeaderSize:], l)
+		b.nextSetMany32(data)
+		if !littleEndian {
+			for i, v := range data {
+				data[i] = bits.ReverseBytes32(v)
+			}
+		}
+	}
+	return buf
+}
+
 // Clone creates a copy of the bitmap.
 func (b *Bitmap) Clone() *Bitmap {
 	b1 := NewBitmap(b.nbits)
 	copy(b1.set, b.set)
 	b1.cardinality = b.cardinality
+	b1.strict = b.strict
+	b1.jsonArray = b.jsonArray
 	return b1
 }
 
@@ -188,20 +352,175 @@ func (b *Bitmap) AndNot(o *Bitmap) {
 	b.cardinality = int(cnt)
 }
 
+// Xor computes the symmetric difference between two bitmaps and stores the result in the current bitmap.
+func (b *Bitmap) Xor(o *Bitmap) {
+	l := len(o.set)
+	cnt := 0
+	for i := 0; i < l; i++ {
+		v := b.set[i] ^ o.set[i]
+		cnt += bits.OnesCount64(v)
+		b.set[i] = v
+	}
+	b.cardinality = int(cnt)
+}
+
+// AndCardinality returns the cardinality of the intersection between two bitmaps, neither bitmap is modified.
+func (b *Bitmap) AndCardinality(o *Bitmap) uint64 {
+	l := min(len(b.set), len(o.set))
+	cnt := 0
+	for i := 0; i < l; i++ {
+		cnt += bits.OnesCount64(b.set[i] & o.set[i])
+	}
+	return uint64(cnt)
+}
+
+// OrCardinality returns the cardinality of the union between two bitmaps, neither bitmap is modified.
+func (b *Bitmap) OrCardinality(o *Bitmap) uint64 {
+	return b.GetCardinality() + o.GetCardinality() - b.AndCardinality(o)
+}
+
+// AndNotCardinality returns the cardinality of the difference between two bitmaps, neither bitmap is modified.
+func (b *Bitmap) AndNotCardinality(o *Bitmap) uint64 {
+	return b.GetCardinality() - b.AndCardinality(o)
+}
+
+// XorCardinality returns the cardinality of the symmetric difference between two bitmaps, neither bitmap is modified.
+func (b *Bitmap) XorCardinality(o *Bitmap) uint64 {
+	return b.GetCardinality() + o.GetCardinality() - 2*b.AndCardinality(o)
+}
+
+// Intersects returns true if the two bitmaps have at least one integer in common.
+func (b *Bitmap) Intersects(o *Bitmap) bool {
+	l := min(len(b.set), len(o.set))
+	for i := 0; i < l; i++ {
+		if b.set[i]&o.set[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // Flip negates the bits in the given range (i.e., [start,stop)), any integer present in this
 // range and in the bitmap is removed, and any integer present in the range and not in the bitmap is added.
 func (b *Bitmap) FlipInt(start, stop int) {
+	b.applyRange(start, stop, func(w, mask uint64) uint64 { return w ^ mask })
+}
+
+// AddRange adds the integers in the given range (i.e., [start,stop)) to the bitmap.
+func (b *Bitmap) AddRange(start, stop int) {
+	b.applyRange(start, stop, func(w, mask uint64) uint64 { return w | mask })
+}
+
+// RemoveRange removes the integers in the given range (i.e., [start,stop)) from the bitmap.
+func (b *Bitmap) RemoveRange(start, stop int) {
+	b.applyRange(start, stop, func(w, mask uint64) uint64 { return w &^ mask })
+}
+
+// applyRange replaces the words covering [start,stop) with op(word, mask), where
+// mask has the bits of the range set, and keeps the cardinality up to date.
+func (b *Bitmap) applyRange(start, stop int, op func(w, mask uint64) uint64) {
+	start, stop = b.clampRange(start, stop)
 	if start >= stop {
 		return
 	}
 	startWord := start >> log2WordSize
-	endWord := stop >> log2WordSize
-	b.set[startWord] ^= ^(^uint64(0) << (start & (wordSize - 1)))
-	for i := startWord; i < endWord; i++ {
-		b.set[i] = ^b.set[i]
+	endWord := (stop - 1) >> log2WordSize
+	first := ^uint64(0) << (start & (wordSize - 1))
+	last := ^uint64(0) >> (-stop & (wordSize - 1))
+	if startWord == endWord {
+		b.setWord(startWord, op(b.set[startWord], first&last))
+		return
+	}
+	b.setWord(startWord, op(b.set[startWord], first))
+	for i := startWord + 1; i < endWord; i++ {
+		b.setWord(i, op(b.set[i], ^uint64(0)))
+	}
+	b.setWord(endWord, op(b.set[endWord], last))
+}
+
+func (b *Bitmap) setWord(i int, w uint64) {
+	b.cardinality += bits.OnesCount64(w) - bits.OnesCount64(b.set[i])
+	b.set[i] = w
+}
+
+// CardinalityInRange returns the number of integers of the bitmap in the range [start,stop).
+func (b *Bitmap) CardinalityInRange(start, stop int) uint64 {
+	start, stop = b.clampRange(start, stop)
+	if start >= stop {
+		return 0
+	}
+	startWord := start >> log2WordSize
+	endWord := (stop - 1) >> log2WordSize
+	first := ^uint64(0) << (start & (wordSize - 1))
+	last := ^uint64(0) >> (-stop & (wordSize - 1))
+	if startWord == endWord {
+		return uint64(bits.OnesCount64(b.set[startWord] & first & last))
+	}
+	cnt := bits.OnesCount64(b.set[startWord] & first)
+	for _, w := range b.set[startWord+1 : endWord] {
+		cnt += bits.OnesCount64(w)
 	}
-	b.set[endWord] ^= ^uint64(0) >> (-stop & (wordSize - 1))
-	b.cardinality = int(b.computeCardinality())
+	return uint64(cnt + bits.OnesCount64(b.set[endWord]&last))
+}
+
+// ContainsAnyInRange returns true if an integer of the range [start,stop) is in the bitmap.
+func (b *Bitmap) ContainsAnyInRange(start, stop int) bool {
+	start, stop = b.clampRange(start, stop)
+	return !b.testRange(start, stop, func(w, mask uint64) bool { return w&mask == 0 })
+}
+
+// ContainsAllInRange returns true if all the integers of the range [start,stop) are in the bitmap.
+func (b *Bitmap) ContainsAllInRange(start, stop int) bool {
+	if start < 0 || stop > b.nbits {
+		return start >= stop
+	}
+	return b.testRange(start, stop, func(w, mask uint64) bool { return w&mask == mask })
+}
+
+// ToArrayInRange returns the integers of the bitmap in the range [start,stop) in sorted order.
+func (b *Bitmap) ToArrayInRange(start, stop int) []uint32 {
+	n := int(b.CardinalityInRange(start, stop))
+	if n == 0 {
+		return []uint32{}
+	}
+	start, _ = b.clampRange(start, stop)
+	values, _ := b.NextMany(uint32(start), make([]uint32, 0, n), n)
+	return values
+}
+
+// clampRange restricts the range [start,stop) to the capacity of the bitmap.
+func (b *Bitmap) clampRange(start, stop int) (int, int) {
+	if start < 0 {
+		start = 0
+	}
+	if stop > b.nbits {
+		stop = b.nbits
+	}
+	return start, stop
+}
+
+// testRange returns true if f(word, mask) is true for all the words covering
+// [start,stop), where mask has the bits of the range set.
+func (b *Bitmap) testRange(start, stop int, f func(w, mask uint64) bool) bool {
+	if start >= stop {
+		return true
+	}
+	startWord := start >> log2WordSize
+	endWord := (stop - 1) >> log2WordSize
+	first := ^uint64(0) << (start & (wordSize - 1))
+	last := ^uint64(0) >> (-stop & (wordSize - 1))
+	if startWord == endWord {
+		return f(b.set[startWord], first&last)
+	}
+	if !f(b.set[startWord], first) {
+		return false
+	}
+	for _, w := range b.set[startWord+1 : endWord] {
+		if !f(w, ^uint64(0)) {
+			return false
+		}
+	}
+	return f(b.set[endWord], last)
 }
 
 // Equals returns true if the two bitmaps are the same, false otherwise.
@@ -240,6 +559,26 @@ func (b *Bitmap) IsEmpty() bool {
 	return b.cardinality == 0
 }
 
+// Minimum returns the smallest integer in the bitmap, or false if it is empty.
+func (b *Bitmap) Minimum() (uint32, bool) {
+	for i, w := range b.set {
+		if w != 0 {
+			return uint32(i<<log2WordSize + bits.TrailingZeros64(w)), true
+		}
+	}
+	return 0, false
+}
+
+// Maximum returns the largest integer in the bitmap, or false if it is empty.
+func (b *Bitmap) Maximum() (uint32, bool) {
+	for i := len(b.set) - 1; i >= 0; i-- {
+		if w := b.set[i]; w != 0 {
+			return uint32(i<<log2WordSize + wordSize - 1 - bits.LeadingZeros64(w)), true
+		}
+	}
+	return 0, false
+}
+
 var bitmapMask [wordSize]uint64
 
 func init() {
@@ -250,11 +589,11 @@ func init() {
 
 // Add the integer x to the bitmap.
 func (b *Bitmap) Add(v uint32) bool {
-	// We're not going to range check here as we'd rather have
-	// a crash than a silent corruption.
-	//if int(v) >= b.nbits {
-	//return false
-	//}
+	// Only strict bitmaps are range checked, otherwise we'd rather
+	// have a crash than a silent corruption.
+	if b.strict && int64(v) >= int64(b.nbits) {
+		return false
+	}
 	idx := v >> log2WordSize // Fast div 64
 	pos := v & 0x3F          // Fast mod 64
 	if has := b.set[idx] & bitmapMask[pos]; has > 0 {
@@ -271,13 +610,31 @@ func (b *Bitmap) AddInt(v int) bool {
 	return b.Add(uint32(v))
 }
 
+// TryAdd adds the integer x to the bitmap, it returns ErrOutOfRange instead
+// of panicking when x is not smaller than nbits.
+func (b *Bitmap) TryAdd(v uint32) (bool, error) {
+	if int64(v) >= int64(b.nbits) {
+		return false, ErrOutOfRange
+	}
+	return b.Add(v), nil
+}
+
+// TryRemove removes the integer x from the bitmap, it returns ErrOutOfRange
+// instead of panicking when x is not smaller than nbits.
+func (b *Bitmap) TryRemove(v uint32) (bool, error) {
+	if int64(v) >= int64(b.nbits) {
+		return false, ErrOutOfRange
+	}
+	return b.Remove(v), nil
+}
+
 // Remove the integer x from the bitmap.
 func (b *Bitmap) Remove(v uint32) bool {
-	// We're not going to range check here as we'd rather have
-	// a crash than a silent corruption.
-	//if int(v) >= b.nbits {
-	//return false
-	//}
+	// Only strict bitmaps are range checked, otherwise we'd rather
+	// have a crash than a silent corruption.
+	if b.strict && int64(v) >= int64(b.nbits) {
+		return false
+	}
 	idx := v >> log2WordSize // Fast div 64
 	pos := v & 0x3F          // Fast mod 64
 	if has := b.set[idx] & bitmapMask[pos]; has > 0 {
@@ -290,11 +647,11 @@ func (b *Bitmap) Remove(v uint32) bool {
 
 // Contains returns true if the integer is contained in the bitmap.
 func (b *Bitmap) Contains(v uint32) bool {
-	// We're not going to range check here as we'd rather have
-	// a crash than a silent corruption.
-	//if int(v) >= b.nbits {
-	//return false
-	//}
+	// Only strict bitmaps are range checked, otherwise we'd rather
+	// have a crash than a silent corruption.
+	if b.strict && int64(v) >= int64(b.nbits) {
+		return false
+	}
 	idx := v >> log2WordSize // Fast div 64
 	pos := v & 0x3F          // Fast mod 64
 	return b.set[idx]&bitmapMask[pos] > 0
@@ -417,6 +774,53 @@ func (b *Bitmap) NextMany(i uint32, buffer []uint32, limit int) ([]uint32, bool)
 	return buffer, false
 }
 
+// PrevMany appends many previous bit sets from the specified index,
+// including possibly the current index and down to limit, in decreasing
+// order. If more is true, there are additional bits to be added.
+//
+// The bits can be paged through from the top as follows:
+//
+//	buf := make([]uint32, 0, 10)
+//	j := uint32(nbits - 1)
+//	for {
+//		var more bool
+//		buf, more = v.PrevMany(j, buf[:0], 10)
+//		// do something with buf
+//		if !more || buf[len(buf)-1] == 0 {
+//			break
+//		}
+//		j = buf[len(buf)-1] - 1
+//	}
+func (b *Bitmap) PrevMany(i uint32, buffer []uint32, limit int) ([]uint32, bool) {
+	if len(b.set) == 0 || limit == 0 {
+		return buffer, false
+	}
+	x := int(i >> log2WordSize)
+	word := b.set[len(b.set)-1]
+	if x < len(b.set) {
+		word = b.set[x] & (^uint64(0) >> (wordSize - 1 - (i & (wordSize - 1))))
+	} else {
+		x = len(b.set) - 1
+	}
+	size := 0
+	for {
+		for word != 0 {
+			r := wordSize - 1 - bits.LeadingZeros64(word)
+			buffer = append(buffer, uint32(x<<log2WordSize+r))
+			size++
+			if size == limit {
+				return buffer, true
+			}
+			word &^= 1 << r
+		}
+		x--
+		if x < 0 {
+			return buffer, false
+		}
+		word = b.set[x]
+	}
+}
+
 // And computes the intersection between the bitmaps and returns the result.
 func AndBitmaps(nbits int, bitmaps ...*Bitmap) *Bitmap {
 	if len(bitmaps) == 0 {
@@ -441,6 +845,18 @@ func OrBitmaps(nbits int, bitmaps ...*Bitmap) *Bitmap {
 	return b
 }
 
+// XorBitmaps computes the symmetric difference between the bitmaps and returns the result.
+func XorBitmaps(nbits int, bitmaps ...*Bitmap) *Bitmap {
+	if len(bitmaps) == 0 {
+		return NewBitmap(nbits)
+	}
+	b := bitmaps[0].Clone()
+	for _, o := range bitmaps[1:] {
+		b.Xor(o)
+	}
+	return b
+}
+
 // AndNot computes the difference between the bitmaps and returns the result.
 func AndNotBitmap(a *Bitmap, b *Bitmap) *Bitmap {
 	c := a.Clone()
@@ -460,29 +876,111 @@ func bodySize(nbits int) int {
 }
 
 func totalSize(nbits int) int {
-	return headerSize + bodySize(nbits)
+	return extHeaderSize + bodySize(nbits)
 }
 
 // Data encoding.
-// 64 bit header.
+// 64 bit header for the legacy encodings and version 1:
+// magic uint32 | encoding uint8 | version uint8 | cardinality uint16
+// 128 bit header from version 2:
+// magic uint32 | encoding uint8 | version uint8 | flags uint16 | cardinality uint32 | nbits uint32
 type header struct {
 	magic       uint32 // magic uint32
 	encoding    byte   // encoding uint8
-	unused      byte   // unused uint8
-	cardinality uint16 // cardinality uint16
+	version     byte   // version uint8, unused by the legacy encodings
+	flags       uint16 // flags, from version 2
+	cardinality uint32 // cardinality, only 16 bits before version 2
+	nbits       uint32 // nbits, from version 2
 }
 
 func (h *header) read(buf []byte) {
-	data := toUint64Slice(buf)
-	v := data[0]
+	v := binary.LittleEndian.Uint64(buf)
+	if uint32(v>>32) != bitmapMagic {
+		// Legacy headers are in the byte order of the host that wrote them.
+		v = toUint64Slice(buf)[0]
+	}
 	h.magic = uint32((v & 0xFFFFFFFF00000000) >> 32)
 	h.encoding = byte((v & 0xFF000000) >> 24)
-	h.cardinality = uint16(v & 0xFFFF)
+	h.version = byte((v & 0xFF0000) >> 16)
+	h.cardinality = uint32(v & 0xFFFF)
+	if h.version >= 2 {
+		h.flags = uint16(v)
+	}
+}
+
+// readExt reads the second half of a version 2 header.
+func (h *header) readExt(buf []byte) {
+	h.cardinality = binary.LittleEndian.Uint32(buf[8:])
+	h.nbits = binary.LittleEndian.Uint32(buf[12:])
 }
 
+// write writes a legacy header in the byte order of the host.
 func (h header) write(buf []byte) {
 	data := toUint64Slice(buf)
-	data[0] = uint64(h.magic)<<32 | uint64(h.encoding)<<24 | uint64(h.cardinality)
+	data[0] = h.value()
+}
+
+// writeLE writes a version 2 header.
+func (h header) writeLE(buf []byte) {
+	binary.LittleEndian.PutUint64(buf, h.value())
+	binary.LittleEndian.PutUint32(buf[8:], h.cardinality)
+	binary.LittleEndian.PutUint32(buf[12:], h.nbits)
+}
+
+func (h header) value() uint64 {
+	v := uint64(h.magic)<<32 | uint64(h.encoding)<<24 | uint64(h.version)<<16
+	if h.version < 2 {
+		v |= uint64(uint16(h.cardinality))
+	} else {
+		v |= uint64(h.flags)
+	}
+	return v
+}
+
+// littleEndian is true if the host is little-endian, in which case the
+// portable encodings have the same layout as the legacy ones.
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// legacyEncoding returns the native encoding matching a portable encoding.
+func legacyEncoding(encoding byte) byte {
+	switch encoding {
+	case encodingBitmapLE:
+		return encodingBitmap
+	case encodingArrayLE:
+		return encodingArray
+	}
+	return encoding
+}
+
+// toNativeEndian returns a copy of a portably encoded buffer with the
+// data converted to the byte order of the host.
+func toNativeEndian(buf []byte, encoding byte, hsize int) []byte {
+	dst := make([]byte, len(buf))
+	copy(dst[:hsize], buf)
+	if len(buf) == hsize {
+		return dst
+	}
+	switch encoding {
+	case encodingBitmapLE:
+		data := toUint64Slice(dst[hsize:])
+		for i := range data {
+			data[i] = binary.LittleEndian.Uint64(buf[hsize+i*8:])
+		}
+	case encodingArrayLE:
+		data := toUint16Slice(dst[hsize:], (len(buf)-hsize)/2)
+		for i := range data {
+			data[i] = binary.LittleEndian.Uint16(buf[hsize+i*2:])
+		}
+	case encodingArray32LE:
+		data := toUint32Slice(dst[hsize:], (len(buf)-hsize)/4)
+		for i := range data {
+			data[i] = binary.LittleEndian.Uint32(buf[hsize+i*4:])
+		}
+	}
+	return dst
 }
 
 func toUint64Slice(b []byte) []uint64 {
@@ -495,6 +993,15 @@ func toUint64Slice(b []byte) []uint64 {
 	return u64s
 }
 
+func toUint32Slice(b []byte, l int) []uint32 {
+	var u32s []uint32
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&u32s))
+	hdr.Len = l
+	hdr.Cap = len(b) / 4
+	hdr.Data = uintptr(unsafe.Pointer(&b[0]))
+	return u32s
+}
+
 func toUint16Slice(b []byte, l int) []uint16 {
 	var u16s []uint16
 	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&u16s))
@@ -0,0 +1,148 @@
+package fixed
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// MaxUnmarshalNbits is the largest nbits that UnmarshalBinary reads from the
+// header of the data into a zero value bitmap, unless the data is at least
+// as large as the bitmap. The header isn't trusted otherwise, since a small
+// array can ask for a bitmap of 512MB.
+var MaxUnmarshalNbits = 1 << 24
+
+// MarshalBinary implements encoding.BinaryMarshaler, it returns the
+// marshaled form, whose header carries nbits.
+func (b *Bitmap) MarshalBinary() ([]byte, error) {
+	if b.buf == nil {
+		// The zero value is an empty bitmap of no bits.
+		b = NewBitmap(0)
+	}
+	return b.Marshal()
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. The nbits are read
+// from the header, so the bitmap may be the zero value, see MaxUnmarshalNbits.
+// Otherwise the data must have been marshaled with the nbits of the bitmap.
+// The legacy and version 1 headers don't carry nbits, they are read into a
+// bitmap created with them. The data is copied.
+func (b *Bitmap) UnmarshalBinary(data []byte) error {
+	nbits, ok, err := headerNbits(data)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !ok && b.buf == nil:
+		return &DecodeError{Err: ErrNbits, Encoding: data[3]}
+	case !ok:
+		nbits = b.nbits
+	case b.buf != nil && nbits != b.nbits:
+		return &DecodeError{Err: ErrNbits, Encoding: data[3], Offset: 12, Expected: b.nbits, Actual: nbits}
+	case b.buf == nil && nbits > MaxUnmarshalNbits && len(data) < totalSize(nbits):
+		return &DecodeError{Err: ErrNbits, Encoding: data[3], Offset: 12, Expected: MaxUnmarshalNbits, Actual: nbits}
+	}
+	o, err := NewBitmapFromBuf(data, nbits, true, b.options()...)
+	if err != nil {
+		return err
+	}
+	*b = *o
+	return nil
+}
+
+// headerNbits returns the nbits of a version 2 header, ok is false for the
+// older headers, which don't carry them.
+func headerNbits(data []byte) (nbits int, ok bool, err error) {
+	if len(data) < headerSize {
+		return 0, false, &DecodeError{Err: ErrInvalidData, Offset: len(data), Expected: headerSize, Actual: len(data)}
+	}
+	var h header
+	h.read(data)
+	if h.magic != bitmapMagic {
+		return 0, false, &DecodeError{Err: ErrBadMagic, Offset: 4}
+	}
+	switch h.encoding {
+	case encodingBitmapLE, encodingArrayLE, encodingArray32LE:
+		switch h.version {
+		case 1:
+			return 0, false, nil
+		case formatVersion:
+		default:
+			return 0, false, &DecodeError{Err: ErrUnsupportedVersion, Encoding: h.encoding, Offset: 2}
+		}
+	default:
+		return 0, false, nil
+	}
+	if len(data) < extHeaderSize {
+		return 0, false, &DecodeError{Err: ErrInvalidData, Encoding: h.encoding, Offset: len(data), Expected: extHeaderSize, Actual: len(data)}
+	}
+	h.readExt(data)
+	return int(h.nbits), true, nil
+}
+
+// MarshalText implements encoding.TextMarshaler, it returns the marshaled
+// form in standard base64.
+func (b *Bitmap) MarshalText() ([]byte, error) {
+	buf, err := b.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(buf)))
+	base64.StdEncoding.Encode(text, buf)
+	return text, nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, see UnmarshalBinary.
+func (b *Bitmap) UnmarshalText(text []byte) error {
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(buf, text)
+	if err != nil {
+		return err
+	}
+	return b.UnmarshalBinary(buf[:n])
+}
+
+// MarshalJSON implements json.Marshaler. It returns the base64 string of
+// MarshalText, or the sorted array of the integers for the bitmaps created
+// with the JSONArray option. The receiver is a value so that the bitmaps
+// held by value in structs that are not addressable use it too.
+func (b Bitmap) MarshalJSON() ([]byte, error) {
+	if b.jsonArray {
+		return json.Marshal(b.ToArray())
+	}
+	text, err := b.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It reads both forms of
+// MarshalJSON, arrays must hold integers smaller than the nbits of the
+// bitmap, otherwise ErrOutOfRange is returned.
+func (b *Bitmap) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		return nil
+	case len(data) > 0 && data[0] == '[':
+		var arr []uint32
+		if err := json.Unmarshal(data, &arr); err != nil {
+			return err
+		}
+		o := NewBitmap(b.nbits, b.options()...)
+		for _, v := range arr {
+			if int64(v) >= int64(o.nbits) {
+				return ErrOutOfRange
+			}
+			o.Add(v)
+		}
+		*b = *o
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	return b.UnmarshalText([]byte(text))
+}
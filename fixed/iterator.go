@@ -0,0 +1,107 @@
+package fixed
+
+import "math/bits"
+
+// Iterator walks the integers of a bitmap in increasing order. It reads
+// the words of the bitmap directly, so the bitmap must not be modified
+// while iterating.
+type Iterator struct {
+	set  []uint64
+	idx  int    // index of the current word
+	word uint64 // bits of the current word not yet returned
+}
+
+// Iterator returns an iterator over the integers of the bitmap.
+func (b *Bitmap) Iterator() *Iterator {
+	it := &Iterator{set: b.set, idx: -1}
+	it.fill()
+	return it
+}
+
+// fill moves to the next word with bits not yet returned, if any.
+func (it *Iterator) fill() {
+	for it.word == 0 && it.idx < len(it.set)-1 {
+		it.idx++
+		it.word = it.set[it.idx]
+	}
+}
+
+// HasNext returns true if there are more integers.
+func (it *Iterator) HasNext() bool {
+	return it.word != 0
+}
+
+// PeekNext returns the next integer without advancing, HasNext must be true.
+func (it *Iterator) PeekNext() uint32 {
+	return uint32(it.idx<<log2WordSize + bits.TrailingZeros64(it.word))
+}
+
+// Next returns the next integer, HasNext must be true.
+func (it *Iterator) Next() uint32 {
+	v := it.PeekNext()
+	it.word &= it.word - 1
+	it.fill()
+	return v
+}
+
+// AdvanceIfNeeded skips the integers smaller than min.
+func (it *Iterator) AdvanceIfNeeded(min uint32) {
+	if !it.HasNext() || it.PeekNext() >= min {
+		return
+	}
+	idx := int(min >> log2WordSize)
+	if idx >= len(it.set) {
+		it.idx = len(it.set) - 1
+		it.word = 0
+		return
+	}
+	if idx > it.idx {
+		it.idx = idx
+		it.word = it.set[idx]
+	}
+	it.word &= ^uint64(0) << (min & (wordSize - 1))
+	it.fill()
+}
+
+// ReverseIterator walks the integers of a bitmap in decreasing order. It
+// reads the words of the bitmap directly, so the bitmap must not be
+// modified while iterating.
+type ReverseIterator struct {
+	set  []uint64
+	idx  int    // index of the current word
+	word uint64 // bits of the current word not yet returned
+}
+
+// ReverseIterator returns an iterator over the integers of the bitmap,
+// starting from the largest.
+func (b *Bitmap) ReverseIterator() *ReverseIterator {
+	it := &ReverseIterator{set: b.set, idx: len(b.set)}
+	it.fill()
+	return it
+}
+
+// fill moves to the previous word with bits not yet returned, if any.
+func (it *ReverseIterator) fill() {
+	for it.word == 0 && it.idx > 0 {
+		it.idx--
+		it.word = it.set[it.idx]
+	}
+}
+
+// HasNext returns true if there are more integers.
+func (it *ReverseIterator) HasNext() bool {
+	return it.word != 0
+}
+
+// PeekNext returns the next integer without advancing, HasNext must be true.
+func (it *ReverseIterator) PeekNext() uint32 {
+	return uint32(it.idx<<log2WordSize + wordSize - 1 - bits.LeadingZeros64(it.word))
+}
+
+// Next returns the next integer, HasNext must be true.
+func (it *ReverseIterator) Next() uint32 {
+	v := it.PeekNext()
+	it.word &^= 1 << (v & (wordSize - 1))
+	it.fill()
+	return v
+}
@@ -0,0 +1,58 @@
+package fixed
+
+type options struct {
+	strict    bool
+	validate  bool
+	jsonArray bool
+}
+
+// Option configures a bitmap created by NewBitmap or NewBitmapFromBuf.
+type Option func(*options)
+
+// Strict range checks the integers given to Add, Remove and Contains. Those
+// that are not smaller than nbits are ignored, instead of panicking or
+// corrupting the bitmap.
+func Strict() Option {
+	return func(o *options) {
+		o.strict = true
+	}
+}
+
+// Validate makes NewBitmapFromBuf check the structure of the marshaled form
+// instead of trusting it, at the cost of a pass over the data. The errors
+// are reported with ErrOutOfRange, ErrUnsorted, ErrCardinality.
+func Validate() Option {
+	return func(o *options) {
+		o.validate = true
+	}
+}
+
+// JSONArray makes MarshalJSON emit the sorted array of the integers instead
+// of a base64 string of the marshaled form. The array doesn't carry nbits,
+// so UnmarshalJSON reads it into a bitmap that already has its nbits.
+func JSONArray() Option {
+	return func(o *options) {
+		o.jsonArray = true
+	}
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// options returns the options the bitmap was created with, for the bitmaps
+// that replace it.
+func (b *Bitmap) options() []Option {
+	var opts []Option
+	if b.strict {
+		opts = append(opts, Strict())
+	}
+	if b.jsonArray {
+		opts = append(opts, JSONArray())
+	}
+	return opts
+}
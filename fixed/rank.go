@@ -0,0 +1,127 @@
+package fixed
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// rankBlockWords is the number of words summarized by each entry in a RankIndex.
+const rankBlockWords = 8
+
+// Rank returns the number of integers in the bitmap that are smaller or equal to x.
+func (b *Bitmap) Rank(x uint32) uint64 {
+	idx := int(x >> log2WordSize)
+	if idx >= len(b.set) {
+		return uint64(b.cardinality)
+	}
+	cnt := bits.OnesCount64(b.set[idx] << (wordSize - 1 - (x & (wordSize - 1))))
+	if idx > len(b.set)/2 {
+		// Closer to the end, count what's after x instead.
+		after := 0
+		for _, w := range b.set[idx+1:] {
+			after += bits.OnesCount64(w)
+		}
+		after += bits.OnesCount64(b.set[idx]) - cnt
+		return uint64(b.cardinality - after)
+	}
+	for _, w := range b.set[:idx] {
+		cnt += bits.OnesCount64(w)
+	}
+	return uint64(cnt)
+}
+
+// Select returns the integer at position k (counting from 0) in the sorted
+// integers of the bitmap. It returns false if k is not less than the cardinality.
+func (b *Bitmap) Select(k uint64) (uint32, bool) {
+	if k >= uint64(b.cardinality) {
+		return 0, false
+	}
+	remaining := int(k)
+	for idx, w := range b.set {
+		cnt := bits.OnesCount64(w)
+		if remaining < cnt {
+			return uint32(idx)<<log2WordSize + selectInWord(w, remaining), true
+		}
+		remaining -= cnt
+	}
+	return 0, false
+}
+
+// RankIndex caches the cumulative cardinality of blocks of words of
+// a bitmap, so that Rank and Select don't need to count all the
+// preceding words. The index is a snapshot of the bitmap, and must be
+// rebuilt once the bitmap is modified.
+type RankIndex struct {
+	b *Bitmap
+	// counts[i] is the number of bits set before block i.
+	counts []uint64
+}
+
+// BuildRankIndex returns a RankIndex for the current content of the bitmap.
+func (b *Bitmap) BuildRankIndex() *RankIndex {
+	blocks := (len(b.set) + rankBlockWords - 1) / rankBlockWords
+	counts := make([]uint64, blocks)
+	cnt := uint64(0)
+	for i := range counts {
+		counts[i] = cnt
+		end := min((i+1)*rankBlockWords, len(b.set))
+		for _, w := range b.set[i*rankBlockWords : end] {
+			cnt += uint64(bits.OnesCount64(w))
+		}
+	}
+	return &RankIndex{
+		b:      b,
+		counts: counts,
+	}
+}
+
+// Rank returns the number of integers in the bitmap that are smaller or equal to x.
+func (r *RankIndex) Rank(x uint32) uint64 {
+	set := r.b.set
+	idx := int(x >> log2WordSize)
+	if idx >= len(set) {
+		return uint64(r.b.cardinality)
+	}
+	block := idx / rankBlockWords
+	cnt := r.counts[block]
+	for _, w := range set[block*rankBlockWords : idx] {
+		cnt += uint64(bits.OnesCount64(w))
+	}
+	return cnt + uint64(bits.OnesCount64(set[idx]<<(wordSize-1-(x&(wordSize-1)))))
+}
+
+// Select returns the integer at position k (counting from 0) in the sorted
+// integers of the bitmap. It returns false if k is not less than the cardinality.
+func (r *RankIndex) Select(k uint64) (uint32, bool) {
+	if k >= uint64(r.b.cardinality) {
+		return 0, false
+	}
+	// Find the last block starting at or before k.
+	block := sort.Search(len(r.counts), func(i int) bool { return r.counts[i] > k }) - 1
+	remaining := int(k - r.counts[block])
+	set := r.b.set
+	for idx := block * rankBlockWords; idx < len(set); idx++ {
+		w := set[idx]
+		cnt := bits.OnesCount64(w)
+		if remaining < cnt {
+			return uint32(idx)<<log2WordSize + selectInWord(w, remaining), true
+		}
+		remaining -= cnt
+	}
+	return 0, false
+}
+
+// selectInWord returns the position of the k-th bit set in w.
+func selectInWord(w uint64, k int) uint32 {
+	for i := 0; i < k; i++ {
+		w &= w - 1
+	}
+	return uint32(bits.TrailingZeros64(w))
+}
+
+func min(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,263 @@
+package fixed
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The portable serialization of the RoaringFormatSpec, see
+// https://github.com/RoaringBitmap/RoaringFormatSpec
+const (
+	serialCookieNoRunContainer = 12346
+	serialCookie               = 12347
+	noOffsetThreshold          = 4
+
+	// Containers with more integers are bitmaps, unless they are runs,
+	// which the fixed bitmap only reads.
+	arrayContainerMax = 4096
+	// bitmapContainerWords is the number of uint64 in a bitmap container.
+	bitmapContainerWords = 1024
+)
+
+// roaringContainer is a container of the RoaringFormatSpec, the integers
+// are either in array, words or runs.
+type roaringContainer struct {
+	key   uint16
+	card  int
+	array []uint16
+	words []uint64
+	runs  []uint16 // start, length pairs
+}
+
+func (c roaringContainer) size() int {
+	switch {
+	case c.runs != nil:
+		return 2 + len(c.runs)*2
+	case c.card <= arrayContainerMax:
+		return c.card * 2
+	}
+	return bitmapContainerWords * 8
+}
+
+// MarshalRoaring returns the RoaringFormatSpec serialization of the bitmap,
+// which can be read by the other roaring bitmap implementations.
+func (b *Bitmap) MarshalRoaring() ([]byte, error) {
+	return marshalRoaring(roaringContainersFromWords(b.set, b.nbits)), nil
+}
+
+// NewBitmapFromRoaring returns a fixed size bitmap with a capacity for nbits of storage.
+// The bitmap is initialized from the RoaringFormatSpec serialization, the buffer is
+// not retained.
+func NewBitmapFromRoaring(buf []byte, nbits int) (*Bitmap, error) {
+	b := NewBitmap(nbits)
+	if err := readRoaring(buf, nbits, func(v uint32) { b.Add(v) }); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// roaringContainersFromWords splits the bitmap in containers of 65536 bits.
+func roaringContainersFromWords(set []uint64, nbits int) []roaringContainer {
+	var containers []roaringContainer
+	for key := 0; key*bitmapContainerWords < len(set) && key<<16 < nbits; key++ {
+		words := set[key*bitmapContainerWords:]
+		if len(words) > bitmapContainerWords {
+			words = words[:bitmapContainerWords]
+		}
+		card := 0
+		for _, w := range words {
+			card += bits.OnesCount64(w)
+		}
+		if card == 0 {
+			continue
+		}
+		c := roaringContainer{key: uint16(key), card: card}
+		if card <= arrayContainerMax {
+			c.array = make([]uint16, 0, card)
+			for i, w := range words {
+				for w != 0 {
+					c.array = append(c.array, uint16(i*64+bits.TrailingZeros64(w)))
+					w &= w - 1
+				}
+			}
+		} else {
+			c.words = words
+		}
+		containers = append(containers, c)
+	}
+	return containers
+}
+
+func marshalRoaring(containers []roaringContainer) []byte {
+	n := len(containers)
+	hasRun := false
+	for _, c := range containers {
+		if c.runs != nil {
+			hasRun = true
+		}
+	}
+	size := 8 + 8*n
+	if hasRun {
+		size = 4 + (n+7)/8 + 4*n
+		if n >= noOffsetThreshold {
+			size += 4 * n
+		}
+	}
+	for _, c := range containers {
+		size += c.size()
+	}
+
+	buf := make([]byte, size)
+	pos := 0
+	if hasRun {
+		binary.LittleEndian.PutUint32(buf, serialCookie|uint32(n-1)<<16)
+		pos += 4
+		for i, c := range containers {
+			if c.runs != nil {
+				buf[pos+i/8] |= 1 << (i % 8)
+			}
+		}
+		pos += (n + 7) / 8
+	} else {
+		binary.LittleEndian.PutUint32(buf, serialCookieNoRunContainer)
+		binary.LittleEndian.PutUint32(buf[4:], uint32(n))
+		pos += 8
+	}
+	for _, c := range containers {
+		binary.LittleEndian.PutUint16(buf[pos:], c.key)
+		binary.LittleEndian.PutUint16(buf[pos+2:], uint16(c.card-1))
+		pos += 4
+	}
+	if !hasRun || n >= noOffsetThreshold {
+		offset := pos + 4*n
+		for _, c := range containers {
+			binary.LittleEndian.PutUint32(buf[pos:], uint32(offset))
+			pos += 4
+			offset += c.size()
+		}
+	}
+	for _, c := range containers {
+		switch {
+		case c.runs != nil:
+			binary.LittleEndian.PutUint16(buf[pos:], uint16(len(c.runs)/2))
+			pos += 2
+			for _, v := range c.runs {
+				binary.LittleEndian.PutUint16(buf[pos:], v)
+				pos += 2
+			}
+		case c.card <= arrayContainerMax:
+			for _, v := range c.array {
+				binary.LittleEndian.PutUint16(buf[pos:], v)
+				pos += 2
+			}
+		default:
+			for i, w := range c.words {
+				binary.LittleEndian.PutUint64(buf[pos+i*8:], w)
+			}
+			pos += bitmapContainerWords * 8
+		}
+	}
+	return buf
+}
+
+// readRoaring calls add for each integer of the RoaringFormatSpec serialization,
+// they must all be smaller than nbits.
+func readRoaring(buf []byte, nbits int, add func(v uint32)) error {
+	if len(buf) < 4 {
+		return truncated(buf, 4)
+	}
+	var n, pos int
+	var runs []byte
+	cookie := binary.LittleEndian.Uint32(buf)
+	switch {
+	case cookie&0xFFFF == serialCookie:
+		n = int(cookie>>16) + 1
+		pos = 4 + (n+7)/8
+		if len(buf) < pos {
+			return truncated(buf, pos)
+		}
+		runs = buf[4:pos]
+	case cookie == serialCookieNoRunContainer:
+		if len(buf) < 8 {
+			return truncated(buf, 8)
+		}
+		n = int(binary.LittleEndian.Uint32(buf[4:]))
+		pos = 8
+	default:
+		return &DecodeError{Err: ErrBadMagic}
+	}
+	if len(buf) < pos+4*n {
+		return truncated(buf, pos+4*n)
+	}
+	descPos := pos
+	descriptions := buf[pos:]
+	pos += 4 * n
+	if runs == nil || n >= noOffsetThreshold {
+		// The offsets are not needed to read the containers in order.
+		pos += 4 * n
+	}
+
+	for i := 0; i < n; i++ {
+		key := uint32(binary.LittleEndian.Uint16(descriptions[4*i:])) << 16
+		card := int(binary.LittleEndian.Uint16(descriptions[4*i+2:])) + 1
+		if int(key) >= nbits {
+			return &DecodeError{Err: ErrOutOfRange, Offset: descPos + 4*i}
+		}
+		switch {
+		case runs != nil && runs[i/8]&(1<<(i%8)) != 0:
+			if len(buf) < pos+2 {
+				return truncated(buf, pos+2)
+			}
+			nruns := int(binary.LittleEndian.Uint16(buf[pos:]))
+			pos += 2
+			if len(buf) < pos+4*nruns {
+				return truncated(buf, pos+4*nruns)
+			}
+			for j := 0; j < nruns; j++ {
+				start := int(binary.LittleEndian.Uint16(buf[pos:]))
+				last := start + int(binary.LittleEndian.Uint16(buf[pos+2:]))
+				pos += 4
+				if last > 0xFFFF || int(key)+last >= nbits {
+					return &DecodeError{Err: ErrOutOfRange, Offset: pos - 4}
+				}
+				for v := start; v <= last; v++ {
+					add(key | uint32(v))
+				}
+			}
+		case card <= arrayContainerMax:
+			if len(buf) < pos+2*card {
+				return truncated(buf, pos+2*card)
+			}
+			for j := 0; j < card; j++ {
+				v := key | uint32(binary.LittleEndian.Uint16(buf[pos:]))
+				pos += 2
+				if int(v) >= nbits {
+					return &DecodeError{Err: ErrOutOfRange, Offset: pos - 2}
+				}
+				add(v)
+			}
+		default:
+			if len(buf) < pos+bitmapContainerWords*8 {
+				return truncated(buf, pos+bitmapContainerWords*8)
+			}
+			for j := 0; j < bitmapContainerWords; j++ {
+				w := binary.LittleEndian.Uint64(buf[pos:])
+				pos += 8
+				for w != 0 {
+					v := key | uint32(j*64+bits.TrailingZeros64(w))
+					w &= w - 1
+					if int(v) >= nbits {
+						return &DecodeError{Err: ErrOutOfRange, Offset: pos - 8}
+					}
+					add(v)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// truncated returns the error for data shorter than size bytes.
+func truncated(buf []byte, size int) error {
+	return &DecodeError{Err: ErrInvalidData, Offset: len(buf), Expected: size, Actual: len(buf)}
+}
@@ -0,0 +1,139 @@
+package fixed
+
+import "io"
+
+// writeChunkSize is the size of the chunks converted by big-endian hosts.
+var writeChunkSize = 4096
+
+// WriteTo writes the marshaled form of the bitmap to w, see Marshal. The
+// words of the bitmap encoding are written without copying them.
+func (b *Bitmap) WriteTo(w io.Writer) (int64, error) {
+	header, ok := b.wordsHeader()
+	if !ok {
+		// Marshal builds the arrays anyway.
+		buf, err := b.Marshal()
+		if err != nil {
+			return 0, err
+		}
+		n, err := w.Write(buf)
+		return int64(n), err
+	}
+	hdr := make([]byte, extHeaderSize)
+	header.writeLE(hdr)
+	n, err := w.Write(hdr)
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := writeLE(w, b.buf[extHeaderSize:], encodingBitmapLE)
+	return int64(n) + m, err
+}
+
+// writeLE writes the data of the encoding, which is in the byte order of the
+// host, in little-endian. Big-endian hosts convert a chunk at a time.
+func writeLE(w io.Writer, data []byte, encoding byte) (int64, error) {
+	if littleEndian {
+		n, err := w.Write(data)
+		return int64(n), err
+	}
+	var n int64
+	for len(data) > 0 {
+		size := len(data)
+		if size > writeChunkSize {
+			size = writeChunkSize
+		}
+		// Swapping the bytes converts both ways.
+		m, err := w.Write(toNativeEndian(data[:size], encoding, 0))
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+		data = data[size:]
+	}
+	return n, nil
+}
+
+// ReadFrom replaces the content of the bitmap with a marshaled form read
+// from r, which must have been marshaled with the nbits of the bitmap. It
+// reads exactly one marshaled form, so several can be read from the same
+// stream. It returns io.EOF if r is at its end, and io.ErrUnexpectedEOF if
+// r ends within the marshaled form.
+func (b *Bitmap) ReadFrom(r io.Reader) (int64, error) {
+	hdr := make([]byte, extHeaderSize)
+	n, err := io.ReadFull(r, hdr[:headerSize])
+	if err != nil {
+		return int64(n), err
+	}
+	var h header
+	h.read(hdr)
+	if h.magic != bitmapMagic {
+		return int64(n), &DecodeError{Err: ErrBadMagic, Offset: 4}
+	}
+	hsize := headerSize
+	switch h.encoding {
+	case encodingBitmapLE, encodingArrayLE, encodingArray32LE:
+		switch h.version {
+		case 1:
+		case formatVersion:
+			hsize = extHeaderSize
+			m, err := io.ReadFull(r, hdr[headerSize:])
+			n += m
+			if err != nil {
+				return int64(n), unexpectedEOF(err)
+			}
+			h.readExt(hdr)
+		default:
+			return int64(n), &DecodeError{Err: ErrUnsupportedVersion, Encoding: h.encoding, Offset: 2}
+		}
+	}
+
+	size, err := marshaledSize(h, hsize, b.nbits)
+	if err != nil {
+		return int64(n), err
+	}
+	buf := make([]byte, size)
+	copy(buf, hdr[:hsize])
+	m, err := io.ReadFull(r, buf[hsize:])
+	n += m
+	if err != nil {
+		return int64(n), unexpectedEOF(err)
+	}
+
+	o, err := NewBitmapFromBuf(buf, b.nbits, false, b.options()...)
+	if err != nil {
+		return int64(n), err
+	}
+	*b = *o
+	return int64(n), nil
+}
+
+// marshaledSize returns the size of the marshaled form starting with the
+// header h of hsize bytes.
+func marshaledSize(h header, hsize int, nbits int) (int, error) {
+	if int64(h.cardinality) > int64(nbits) {
+		return 0, &DecodeError{Err: ErrCardinality, Encoding: h.encoding, Offset: 8}
+	}
+	size := hsize
+	switch legacyEncoding(h.encoding) {
+	case encodingBitmap:
+		size += bodySize(nbits)
+	case encodingArray:
+		size += int(h.cardinality) * 2
+	case encodingArray32LE:
+		size += int(h.cardinality) * 4
+	default:
+		return 0, &DecodeError{Err: ErrBadEncoding, Encoding: h.encoding, Offset: 3}
+	}
+	if h.flags&flagChecksum != 0 {
+		size += checksumSize
+	}
+	return size, nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for the reads that
+// are within a marshaled form.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}